@@ -17,20 +17,64 @@
 package config
 
 import (
-// "github.com/rtmfpew/rtmfpew/protocol/vlu"
+	"time"
+	// "github.com/rtmfpew/rtmfpew/protocol/vlu"
 )
 
 type configValues struct {
 	Mtu                 uint
+	MaxMtu              uint
 	MaxFragmentationGap uint
 	MaxFragments        int
 	MaxFragmentsSize    uint16
+	ReassemblyTimeout   time.Duration
+	SchedulerInterval   time.Duration
+
+	HandshakeTimeout            time.Duration
+	HandshakeRetransmitInterval time.Duration
+	CookieLifetime              time.Duration
+
+	DelayedAckTimeout time.Duration
+	ReceiveBufferSize int
+	FlowLingerTimeout time.Duration
+
+	RetransmitTimeout    time.Duration
+	MinRetransmitTimeout time.Duration
+	MaxRetransmitTimeout time.Duration
+
+	KeepaliveInterval  time.Duration
+	MaxUnansweredPings int
+
+	CloseTimeout       time.Duration
+	CloseLingerTimeout time.Duration
 }
 
 var values = &configValues{
 	Mtu:                 768,
+	MaxMtu:              1472,
 	MaxFragmentationGap: 3,
-	MaxFragments:        4,
+	MaxFragments:        16,
+	MaxFragmentsSize:    16 * 1024,
+	ReassemblyTimeout:   5 * time.Second,
+	SchedulerInterval:   4 * time.Millisecond,
+
+	HandshakeTimeout:            30 * time.Second,
+	HandshakeRetransmitInterval: 1500 * time.Millisecond,
+	CookieLifetime:              2 * time.Minute,
+
+	DelayedAckTimeout: 200 * time.Millisecond,
+	ReceiveBufferSize: 64 * 1024,
+	FlowLingerTimeout: 120 * time.Second,
+
+	RetransmitTimeout:    1500 * time.Millisecond,
+	MinRetransmitTimeout: 250 * time.Millisecond,
+	MaxRetransmitTimeout: 10 * time.Second,
+
+	KeepaliveInterval:  10 * time.Second,
+	MaxUnansweredPings: 3,
+
+	CloseTimeout:       90 * time.Second,
+	CloseLingerTimeout: 19 * time.Second,
 }
 
 // Load loads config values from file
@@ -43,6 +87,11 @@ func Mtu() uint {
 	return values.Mtu
 }
 
+// MaxMtu returns the largest packet size path MTU discovery probes for
+func MaxMtu() uint {
+	return values.MaxMtu
+}
+
 // MaxFragmentationGap returns max gap for fragmented packets
 func MaxFragmentationGap() uint {
 	return values.MaxFragmentationGap
@@ -53,6 +102,83 @@ func MaxFragments() int {
 	return values.MaxFragments
 }
 
+// MaxFragmentsSize returns max size of the reassembled packet
 func MaxFragmentsSize() uint16 {
 	return values.MaxFragmentsSize
 }
+
+// ReassemblyTimeout returns time to give up reassembly of the fragmented packet
+func ReassemblyTimeout() time.Duration {
+	return values.ReassemblyTimeout
+}
+
+// SchedulerInterval returns how often endpoint flushes outgoing packets
+func SchedulerInterval() time.Duration {
+	return values.SchedulerInterval
+}
+
+// HandshakeTimeout returns time to give up session handshake
+func HandshakeTimeout() time.Duration {
+	return values.HandshakeTimeout
+}
+
+// HandshakeRetransmitInterval returns initial handshake retransmission interval
+func HandshakeRetransmitInterval() time.Duration {
+	return values.HandshakeRetransmitInterval
+}
+
+// CookieLifetime returns how long handshake cookies are valid and secrets live
+func CookieLifetime() time.Duration {
+	return values.CookieLifetime
+}
+
+// DelayedAckTimeout returns how long acknowledgement of user data can be delayed
+func DelayedAckTimeout() time.Duration {
+	return values.DelayedAckTimeout
+}
+
+// ReceiveBufferSize returns receive buffer size of every flow in bytes
+func ReceiveBufferSize() int {
+	return values.ReceiveBufferSize
+}
+
+// FlowLingerTimeout returns how long finished receive flows are kept
+// to acknowledge retransmitted final fragments
+func FlowLingerTimeout() time.Duration {
+	return values.FlowLingerTimeout
+}
+
+// RetransmitTimeout returns initial user data retransmission timeout
+func RetransmitTimeout() time.Duration {
+	return values.RetransmitTimeout
+}
+
+// MinRetransmitTimeout returns lower bound of user data retransmission timeout
+func MinRetransmitTimeout() time.Duration {
+	return values.MinRetransmitTimeout
+}
+
+// MaxRetransmitTimeout returns upper bound of backed off retransmission timeout
+func MaxRetransmitTimeout() time.Duration {
+	return values.MaxRetransmitTimeout
+}
+
+// KeepaliveInterval returns how long session can be idle before it's pinged
+func KeepaliveInterval() time.Duration {
+	return values.KeepaliveInterval
+}
+
+// MaxUnansweredPings returns number of unanswered pings after which session is dead
+func MaxUnansweredPings() int {
+	return values.MaxUnansweredPings
+}
+
+// CloseTimeout returns how long close request is retransmitted until it's acknowledged
+func CloseTimeout() time.Duration {
+	return values.CloseTimeout
+}
+
+// CloseLingerTimeout returns how long session closed by the far end answers close requests
+func CloseLingerTimeout() time.Duration {
+	return values.CloseLingerTimeout
+}
@@ -0,0 +1,146 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package rtmfp
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/rtmfpew/rtmfpew/protocol"
+	"github.com/rtmfpew/rtmfpew/protocol/connection"
+	"github.com/rtmfpew/rtmfpew/protocol/connection/flow"
+	"github.com/rtmfpew/rtmfpew/protocol/session"
+)
+
+// Conn is an established RTMFP session with a far end
+type Conn struct {
+	endpoint *protocol.Context
+	session  *session.Session
+	url      *url.URL
+
+	ownsEndpoint bool // Dialed connections have own endpoint
+	closeOnce    sync.Once
+	closeErr     error
+}
+
+func newConn(endpoint *protocol.Context, s *session.Session, url *url.URL, ownsEndpoint bool) *Conn {
+	return &Conn{
+		endpoint:     endpoint,
+		session:      s,
+		url:          url,
+		ownsEndpoint: ownsEndpoint,
+	}
+}
+
+// URL returns dialed address, it's nil for accepted connections
+func (conn *Conn) URL() *url.URL {
+	return conn.url
+}
+
+// SessionID returns near end session ID
+func (conn *Conn) SessionID() uint32 {
+	return conn.session.ID
+}
+
+// PeerAddress returns far end address
+func (conn *Conn) PeerAddress() *connection.PeerAddress {
+	return conn.session.PeerAddress()
+}
+
+// LocalAddr returns near end network address
+func (conn *Conn) LocalAddr() net.Addr {
+	return conn.endpoint.Addr()
+}
+
+// RemoteAddr returns far end network address or nil if it's unknown yet
+func (conn *Conn) RemoteAddr() net.Addr {
+	if addr := conn.session.Addr(); addr != nil {
+		return addr
+	}
+
+	return nil
+}
+
+// Flows returns open flows of the connection
+func (conn *Conn) Flows() []flow.Flow {
+	return conn.session.Flows()
+}
+
+// OpenFlow opens a new flow to the far end, metadata may be nil
+func (conn *Conn) OpenFlow(metadata []byte) *flow.SendFlow {
+	return conn.session.OpenFlow(metadata)
+}
+
+// OpenReturnFlow opens a new flow to the far end in return for the received one
+func (conn *Conn) OpenReturnFlow(metadata []byte, in *flow.ReceiveFlow) *flow.SendFlow {
+	return conn.session.OpenReturnFlow(metadata, in.ID())
+}
+
+// SetFlowAcceptor sets handler of the flows opened by the far end
+func (conn *Conn) SetFlowAcceptor(acceptor session.FlowAcceptor) {
+	conn.session.SetFlowAcceptor(acceptor)
+}
+
+// Done returns channel which is closed when connection is closed by the session
+func (conn *Conn) Done() <-chan struct{} {
+	return conn.session.Done()
+}
+
+// Err returns reason the session of the connection is closed for, like
+// *session.SessionTimeoutError when the far end stopped answering pings
+func (conn *Conn) Err() error {
+	return conn.session.Err()
+}
+
+// Stats returns transport statistics of the connection
+func (conn *Conn) Stats() session.Stats {
+	return conn.session.Stats()
+}
+
+// closeWait is how long Close waits for the far end to acknowledge close
+// before endpoint of the dialed connection is closed
+const closeWait = 3 * time.Second
+
+// Close gracefully closes the session of the connection. Endpoint is closed
+// too if it was dialed, once the far end acknowledges close or closeWait passes.
+func (conn *Conn) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), closeWait)
+	defer cancel()
+
+	return conn.CloseContext(ctx)
+}
+
+// CloseContext is Close waiting for the far end to acknowledge close until ctx is done
+func (conn *Conn) CloseContext(ctx context.Context) error {
+	conn.closeOnce.Do(func() {
+		conn.session.Close()
+
+		if conn.ownsEndpoint {
+			select {
+			case <-conn.session.Done():
+			case <-ctx.Done():
+			}
+
+			conn.closeErr = conn.endpoint.Close()
+		}
+	})
+
+	return conn.closeErr
+}
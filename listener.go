@@ -0,0 +1,49 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package rtmfp
+
+import (
+	"context"
+	"net"
+
+	"github.com/rtmfpew/rtmfpew/protocol"
+)
+
+// Listener accepts RTMFP sessions, it's similar to net.Listener
+type Listener struct {
+	endpoint *protocol.Context
+}
+
+// Accept waits for and returns the next connection
+func (listener *Listener) Accept(ctx context.Context) (*Conn, error) {
+	s, err := listener.endpoint.Accept(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return newConn(listener.endpoint, s, nil, false), nil
+}
+
+// Close stops listening, blocked Accept calls return protocol.ErrClosed
+func (listener *Listener) Close() error {
+	return listener.endpoint.Close()
+}
+
+// Addr returns listener's network address
+func (listener *Listener) Addr() net.Addr {
+	return listener.endpoint.Addr()
+}
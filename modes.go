@@ -18,60 +18,46 @@ package rtmfp
 
 import (
 	"net"
+	"strconv"
+	"strings"
 
 	"github.com/rtmfpew/rtmfpew/protocol"
 )
 
-func serverlessMode() (*protocol.Context, error) {
-
-	addr := net.ResolveUDPAddr("udp", "0.0.0.0")
-	if addr.Port == 0 {
-		addr.Port = DefaultPort
-	}
-
-	conn, err := net.ListenUDP("udp", &addr)
-	defer conn.Close()
-	if err != nil {
-		return nil, err
+// withDefaultPort adds DefaultPort to the host without one,
+// explicit port including ephemeral :0 is kept as is
+func withDefaultPort(host string) string {
+	if _, port, err := net.SplitHostPort(host); err == nil {
+		if len(port) > 0 {
+			return host
+		}
+		host = host[:len(host)-1]
 	}
 
-	ctx := &protocol.Context{}
-
-	return ctx, nil
+	return net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(DefaultPort))
 }
 
-func clientMode(host string) (*protocol.Context, error) {
+func clientMode(host string) (*protocol.Context, *net.UDPAddr, error) {
 
-	addr := net.ResolveUDPAddr("udp", host)
-	if addr.Port == 0 {
-		addr.Port = DefaultPort
+	addr, err := net.ResolveUDPAddr("udp", withDefaultPort(host))
+	if err != nil {
+		return nil, nil, err
 	}
 
-	conn, err := net.DialUDP("udp", nil, addr)
-	defer conn.Close()
+	ctx, err := protocol.Run(":0", protocol.ClientMode)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	ctx := &protocol.Context{}
-
-	return ctx, nil
+	return ctx, addr, nil
 }
 
 func serverMode(host string) (*protocol.Context, error) {
 
-	addr := net.ResolveUDPAddr("udp", host)
-	if addr.Port == 0 {
-		addr.Port = DefaultPort
-	}
-
-	conn, err := net.ListenUDP("udp", &addr)
-	defer conn.Close()
+	addr, err := net.ResolveUDPAddr("udp", withDefaultPort(host))
 	if err != nil {
 		return nil, err
 	}
 
-	ctx := &protocol.Context{}
-
-	return ctx, nil
+	return protocol.Run(addr.String(), protocol.ServerMode)
 }
@@ -108,7 +108,15 @@ func (chnk *DataAcknowledgementBitmapChunk) ReadFrom(buffer *bytes.Buffer) error
 		chnk.BufferBlocksAvailable.ByteLength() -
 		chnk.CumulativeAck.ByteLength()
 
+	if ackLength < 0 {
+		return errors.New("Can't read DataAckBitmap chunk acknowledgement")
+	}
+
 	chnk.Acknowledgement = make([]byte, ackLength)
+	if ackLength == 0 {
+		return nil
+	}
+
 	num, err := buffer.Read(chnk.Acknowledgement)
 
 	if err != nil {
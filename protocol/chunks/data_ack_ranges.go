@@ -71,24 +71,29 @@ func (chnk *DataAcknowledgementRangesChunk) WriteTo(buffer *bytes.Buffer) error
 
 	// Contents
 	if err = binary.Write(buffer, binary.BigEndian, chnk.Len()-1); err != nil {
-		return nil
+		return err
 	}
 
 	if err = chnk.FlowID.WriteTo(buffer); err != nil {
-		return nil
+		return err
 	}
 
 	if err = chnk.BufferBlocksAvailable.WriteTo(buffer); err != nil {
-		return nil
+		return err
 	}
 
 	if err = chnk.CumulativeAck.WriteTo(buffer); err != nil {
-		return nil
+		return err
 	}
 
 	for i := range chnk.Ranges {
-		chnk.Ranges[i].HolesMinusOne.WriteTo(buffer)
-		chnk.Ranges[i].ReceivedMinusOne.WriteTo(buffer)
+		if err = chnk.Ranges[i].HolesMinusOne.WriteTo(buffer); err != nil {
+			return err
+		}
+
+		if err = chnk.Ranges[i].ReceivedMinusOne.WriteTo(buffer); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -19,6 +19,7 @@ package chunks
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 
 	"github.com/rtmfpew/amfy/vlu"
 )
@@ -109,7 +110,11 @@ func (chnk *FragmentChunk) ReadFrom(buffer *bytes.Buffer) error {
 		return err
 	}
 
-	fragmentLength := (int(length) - chnk.PacketID.ByteLength() - chnk.FragmentNum.ByteLength())
+	fragmentLength := (int(length) - 1 - chnk.PacketID.ByteLength() - chnk.FragmentNum.ByteLength()) // flags
+	if fragmentLength < 0 || fragmentLength > buffer.Len() {
+		return errors.New("Wrong fragment chunk length")
+	}
+
 	chnk.Fragment = make([]byte, fragmentLength)
 
 	if _, err = buffer.Read(chnk.Fragment); err != nil {
@@ -150,7 +150,16 @@ func (chnk *InitiatorInitialKeyingChunk) ReadFrom(buffer *bytes.Buffer) error {
 
 // ChangeCookie creates HelloCookieChangeChunk to change cookie of InitiatorInitialKeyingChunk
 func (keying *InitiatorInitialKeyingChunk) ChangeCookie(hello *ResponderHelloChunk) (freshCookie *HelloCookieChangeChunk, err error) {
-	return nil, nil
+	if bytes.Equal(keying.CookieEcho, hello.Cookie) {
+		return nil, errors.New("Cookie is not changed")
+	}
+
+	freshCookie = &HelloCookieChangeChunk{
+		OldCookie: keying.CookieEcho,
+		NewCookie: hello.Cookie,
+	}
+
+	return freshCookie, nil
 }
 
 // RespondKeying creates ResponderInitialKeyingChunk
@@ -65,3 +65,29 @@ func TestInitiatorInitialKeyingIO(t *testing.T) {
 		})
 	})
 }
+
+func TestInitiatorInitialKeyingChangeCookie(t *testing.T) {
+	Convey("Given a initiator initial keying chunk", t, func() {
+
+		chnk := InitiatorInitialKeyingChunkSample()
+
+		Convey("Cookie can be changed with a fresh responder hello", func() {
+			hello := ResponderHelloChunkSample()
+
+			change, err := chnk.ChangeCookie(hello)
+			So(err, ShouldBeNil)
+			So(change.OldCookie, ShouldResemble, chnk.CookieEcho)
+			So(change.NewCookie, ShouldResemble, hello.Cookie)
+		})
+
+		Convey("Cookie can't be changed with the same one", func() {
+			hello := &ResponderHelloChunk{
+				Cookie: chnk.CookieEcho,
+			}
+
+			change, err := chnk.ChangeCookie(hello)
+			So(err, ShouldNotBeNil)
+			So(change, ShouldBeNil)
+		})
+	})
+}
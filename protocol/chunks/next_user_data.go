@@ -22,7 +22,8 @@ import (
 
 const NextUserDataChunkType = 0x11
 
-// NextUserDataChunk equivalent to UserData
+// NextUserDataChunk is a user data chunk following the previous one in the packet.
+// Flow ID is the same, sequence number and FSN offset are the next ones, they aren't sent.
 type NextUserDataChunk UserDataChunk
 
 // Type returns NextUserDataChunk type opcode.
@@ -31,26 +32,27 @@ func (chnk *NextUserDataChunk) Type() byte {
 }
 
 func (chnk *NextUserDataChunk) Len() uint16 {
-	dataChnk := UserDataChunk(*chnk)
-	return dataChnk.Len()
+	return uint16(1 + (*UserDataChunk)(chnk).bodyLen())
 }
 
 func (chnk *NextUserDataChunk) WriteTo(buffer *bytes.Buffer) error {
-	dataChnk := UserDataChunk(*chnk)
-	err := dataChnk.WriteNextTo(buffer, chnk.Type())
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return (*UserDataChunk)(chnk).writeTo(buffer, chnk.Type(), false)
 }
 
 func (chnk *NextUserDataChunk) ReadFrom(buffer *bytes.Buffer) error {
-	dataChnk := UserDataChunk(*chnk)
-	err := dataChnk.ReadFrom(buffer)
-	if err != nil {
-		return err
-	}
+	return (*UserDataChunk)(chnk).readFrom(buffer, false)
+}
+
+// Follows checks if chunk can be sent as the next one after prev
+func (chnk *NextUserDataChunk) Follows(prev *UserDataChunk) bool {
+	return chnk.FlowID == prev.FlowID &&
+		chnk.SequenceNumber == prev.SequenceNumber+1 &&
+		chnk.FsnOffset == prev.FsnOffset+1
+}
 
-	return nil
+// Follow fills the fields implied by the previous chunk
+func (chnk *NextUserDataChunk) Follow(prev *UserDataChunk) {
+	chnk.FlowID = prev.FlowID
+	chnk.SequenceNumber = prev.SequenceNumber + 1
+	chnk.FsnOffset = prev.FsnOffset + 1
 }
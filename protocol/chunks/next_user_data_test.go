@@ -0,0 +1,80 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package chunks
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rtmfpew/amfy/vlu"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNextUserDataIO(t *testing.T) {
+	Convey("Given a user data chunk and the next one", t, func() {
+		prev := &UserDataChunk{
+			FragmentControl: BeginFragmentControl,
+			FlowID:          vlu.Vlu(3),
+			SequenceNumber:  vlu.Vlu(7),
+			FsnOffset:       vlu.Vlu(2),
+			UserData:        []byte{0x01, 0x02},
+		}
+
+		chnk := &NextUserDataChunk{
+			FragmentControl: EndFragmentControl,
+			Final:           true,
+			FlowID:          vlu.Vlu(3),
+			SequenceNumber:  vlu.Vlu(8),
+			FsnOffset:       vlu.Vlu(3),
+			UserData:        []byte{0x03, 0x04, 0x05},
+		}
+
+		So(chnk.Follows(prev), ShouldBeTrue)
+
+		buff := bytes.NewBuffer(make([]byte, 0))
+		So(chnk.WriteTo(buff), ShouldBeNil)
+
+		Convey("Implied fields shouldn't be written", func() {
+			So(buff.Len(), ShouldEqual, int(chnk.Len())+2)
+			So(chnk.Len(), ShouldBeLessThan, (*UserDataChunk)(chnk).Len())
+		})
+
+		Convey("It can be read back and follow the previous chunk", func() {
+			typ, _ := buff.ReadByte()
+			So(typ, ShouldEqual, NextUserDataChunkType)
+
+			readChnk := &NextUserDataChunk{}
+			So(readChnk.ReadFrom(buff), ShouldBeNil)
+			So(buff.Len(), ShouldEqual, 0)
+
+			So(readChnk.FragmentControl, ShouldEqual, EndFragmentControl)
+			So(readChnk.Final, ShouldBeTrue)
+			So(readChnk.UserData, ShouldResemble, chnk.UserData)
+
+			readChnk.Follow(prev)
+			So(readChnk.FlowID, ShouldEqual, 3)
+			So(readChnk.SequenceNumber, ShouldEqual, 8)
+			So(readChnk.FsnOffset, ShouldEqual, 3)
+		})
+
+		Convey("Chunk of another flow shouldn't follow", func() {
+			chnk.FlowID = 4
+			So(chnk.Follows(prev), ShouldBeFalse)
+		})
+	})
+}
@@ -29,7 +29,7 @@ const UserDataChunkType = 0x10
 
 // UserDataChunk fragment control modes
 const (
-	WholeFragmentControl = 0
+	WholeFragmentControl = iota
 	BeginFragmentControl
 	EndFragmentControl
 	MiddleFragmentControl
@@ -56,13 +56,21 @@ func (chnk *UserDataChunk) Type() byte {
 }
 
 func (chnk *UserDataChunk) Len() uint16 {
-	l := 1 +
-		1 + // flags
-		chnk.FlowID.ByteLength() +
+	return uint16(1 + chnk.fieldsLen() + chnk.bodyLen())
+}
+
+// fieldsLen is a length of fields omitted in the next user data chunk
+func (chnk *UserDataChunk) fieldsLen() int {
+	return chnk.FlowID.ByteLength() +
 		chnk.SequenceNumber.ByteLength() +
-		chnk.FsnOffset.ByteLength() +
-		len(chnk.UserData)
-	if chnk.OptionsPresent {
+		chnk.FsnOffset.ByteLength()
+}
+
+// bodyLen is a length of flags, options and user data
+func (chnk *UserDataChunk) bodyLen() int {
+	l := 1 + len(chnk.UserData)
+
+	if len(chnk.Options) > 0 {
 		for _, opt := range chnk.Options {
 			l += opt.Length()
 		}
@@ -70,14 +78,14 @@ func (chnk *UserDataChunk) Len() uint16 {
 		l += 1 // for opt list marker
 	}
 
-	return uint16(l)
+	return l
 }
 
 func (chnk *UserDataChunk) WriteTo(buffer *bytes.Buffer) error {
-	return chnk.WriteNextTo(buffer, chnk.Type())
+	return chnk.writeTo(buffer, chnk.Type(), true)
 }
 
-func (chnk *UserDataChunk) WriteNextTo(buffer *bytes.Buffer, typ byte) error {
+func (chnk *UserDataChunk) writeTo(buffer *bytes.Buffer, typ byte, withFields bool) error {
 
 	// Chunk header
 	err := buffer.WriteByte(typ)
@@ -87,7 +95,12 @@ func (chnk *UserDataChunk) WriteNextTo(buffer *bytes.Buffer, typ byte) error {
 
 	chnk.OptionsPresent = len(chnk.Options) > 0
 
-	if err = binary.Write(buffer, binary.BigEndian, chnk.Len()-1); err != nil {
+	length := uint16(chnk.bodyLen())
+	if withFields {
+		length += uint16(chnk.fieldsLen())
+	}
+
+	if err = binary.Write(buffer, binary.BigEndian, length); err != nil {
 		return err
 	}
 
@@ -114,16 +127,18 @@ func (chnk *UserDataChunk) WriteNextTo(buffer *bytes.Buffer, typ byte) error {
 		return err
 	}
 
-	if err = chnk.FlowID.WriteTo(buffer); err != nil {
-		return err
-	}
+	if withFields {
+		if err = chnk.FlowID.WriteTo(buffer); err != nil {
+			return err
+		}
 
-	if err = chnk.SequenceNumber.WriteTo(buffer); err != nil {
-		return err
-	}
+		if err = chnk.SequenceNumber.WriteTo(buffer); err != nil {
+			return err
+		}
 
-	if err = chnk.FsnOffset.WriteTo(buffer); err != nil {
-		return err
+		if err = chnk.FsnOffset.WriteTo(buffer); err != nil {
+			return err
+		}
 	}
 
 	if chnk.OptionsPresent {
@@ -132,11 +147,11 @@ func (chnk *UserDataChunk) WriteNextTo(buffer *bytes.Buffer, typ byte) error {
 				return err
 			}
 		}
-	}
 
-	marker := vlu.Vlu(0)
-	if err = marker.WriteTo(buffer); err != nil {
-		return err
+		marker := vlu.Vlu(0)
+		if err = marker.WriteTo(buffer); err != nil {
+			return err
+		}
 	}
 
 	if _, err = buffer.Write(chnk.UserData); err != nil {
@@ -147,6 +162,10 @@ func (chnk *UserDataChunk) WriteNextTo(buffer *bytes.Buffer, typ byte) error {
 }
 
 func (chnk *UserDataChunk) ReadFrom(buffer *bytes.Buffer) error {
+	return chnk.readFrom(buffer, true)
+}
+
+func (chnk *UserDataChunk) readFrom(buffer *bytes.Buffer, withFields bool) error {
 
 	// Chunk header
 	length := uint16(0)
@@ -170,23 +189,25 @@ func (chnk *UserDataChunk) ReadFrom(buffer *bytes.Buffer) error {
 	flags >>= 3
 	chnk.OptionsPresent = (flags & 1) != 0
 
-	if err = chnk.FlowID.ReadFrom(buffer); err != nil {
-		return err
-	}
+	dataLength := int(length) - 1
 
-	if err = chnk.SequenceNumber.ReadFrom(buffer); err != nil {
-		return err
-	}
+	if withFields {
+		if err = chnk.FlowID.ReadFrom(buffer); err != nil {
+			return err
+		}
 
-	if err = chnk.FsnOffset.ReadFrom(buffer); err != nil {
-		return err
-	}
+		if err = chnk.SequenceNumber.ReadFrom(buffer); err != nil {
+			return err
+		}
 
-	dataLength := int(length) - 1 -
-		chnk.FlowID.ByteLength() -
-		chnk.SequenceNumber.ByteLength() -
-		chnk.FsnOffset.ByteLength()
+		if err = chnk.FsnOffset.ReadFrom(buffer); err != nil {
+			return err
+		}
 
+		dataLength -= chnk.fieldsLen()
+	}
+
+	chnk.Options = nil
 	if chnk.OptionsPresent {
 		optList := list.New()
 
@@ -196,6 +217,7 @@ func (chnk *UserDataChunk) ReadFrom(buffer *bytes.Buffer) error {
 			optLen, _ = opt.ReadFrom(buffer)
 
 			if optLen == 0 {
+				dataLength-- // Marker
 				break
 			}
 
@@ -203,7 +225,7 @@ func (chnk *UserDataChunk) ReadFrom(buffer *bytes.Buffer) error {
 			optList.PushBack(opt)
 		}
 
-		if dataLength <= 0 {
+		if dataLength < 0 {
 			return errors.New("Corrupted data packet")
 		}
 
@@ -216,6 +238,10 @@ func (chnk *UserDataChunk) ReadFrom(buffer *bytes.Buffer) error {
 		}
 	}
 
+	if dataLength < 0 || dataLength > buffer.Len() {
+		return errors.New("Corrupted data packet")
+	}
+
 	chnk.UserData = make([]byte, dataLength)
 	if _, err := buffer.Read(chnk.UserData); err != nil {
 		return err
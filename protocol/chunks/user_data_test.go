@@ -20,6 +20,8 @@ import (
 	"bytes"
 	"testing"
 
+	"github.com/rtmfpew/amfy/vlu"
+
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -66,5 +68,52 @@ func TestUserDataIO(t *testing.T) {
 				So(readChnk.UserData[i], ShouldEqual, chnk.UserData[i])
 			}
 		})
+
+		Convey("It should be read back without trailing bytes", func() {
+			buff.ReadByte()
+
+			readChnk := &UserDataChunk{}
+			So(readChnk.ReadFrom(buff), ShouldBeNil)
+			So(readChnk.UserData, ShouldResemble, chnk.UserData)
+			So(buff.Len(), ShouldEqual, 0)
+		})
+	})
+
+	Convey("Given a user data chunk without options", t, func() {
+		chnk := &UserDataChunk{
+			FragmentControl: EndFragmentControl,
+			Final:           true,
+			FlowID:          vlu.Vlu(3),
+			SequenceNumber:  vlu.Vlu(7),
+			FsnOffset:       vlu.Vlu(2),
+			UserData:        []byte{0x01, 0x02, 0x03},
+		}
+
+		buff := bytes.NewBuffer(make([]byte, 0))
+		So(chnk.WriteTo(buff), ShouldBeNil)
+		So(buff.Len(), ShouldEqual, int(chnk.Len())+2)
+
+		Convey("It can be read back exactly", func() {
+			buff.ReadByte()
+
+			readChnk := &UserDataChunk{}
+			So(readChnk.ReadFrom(buff), ShouldBeNil)
+			So(readChnk.OptionsPresent, ShouldBeFalse)
+			So(readChnk.FragmentControl, ShouldEqual, EndFragmentControl)
+			So(readChnk.Final, ShouldBeTrue)
+			So(readChnk.UserData, ShouldResemble, chnk.UserData)
+			So(buff.Len(), ShouldEqual, 0)
+		})
+
+		Convey("Fragment control modes should be distinct", func() {
+			modes := map[byte]bool{
+				WholeFragmentControl:  true,
+				BeginFragmentControl:  true,
+				EndFragmentControl:    true,
+				MiddleFragmentControl: true,
+			}
+
+			So(len(modes), ShouldEqual, 4)
+		})
 	})
 }
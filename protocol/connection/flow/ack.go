@@ -0,0 +1,244 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package flow
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+
+	"github.com/rtmfpew/amfy/vlu"
+	"github.com/rtmfpew/rtmfpew/protocol/chunks"
+)
+
+// BufferBlockSize is a unit of receive buffer advertised in acknowledgements
+const BufferBlockSize = 1024
+
+// AckChunk is either bitmap or ranges acknowledgement chunk
+type AckChunk interface {
+	Type() byte
+	Len() uint16
+	WriteTo(buffer *bytes.Buffer) error
+	ReadFrom(buffer *bytes.Buffer) error
+}
+
+// NeedsAck reports whether flow has fragments to be acknowledged
+// and whether acknowledgement shouldn't be delayed
+func (f *ReceiveFlow) NeedsAck() (pending bool, immediate bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.ackPending, f.ackNow
+}
+
+// Acknowledgement returns the smaller of bitmap and ranges encodings
+// of received fragments and resets acknowledgement state
+func (f *ReceiveFlow) Acknowledgement() AckChunk {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.ackPending = false
+	f.ackNow = false
+
+	seqs := make([]vlu.Vlu, 0, len(f.fragments))
+	for seq := range f.fragments {
+		seqs = append(seqs, seq)
+	}
+
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	available := f.bufferAvailable()
+	f.windowClosed = available == 0
+
+	ranges := &chunks.DataAcknowledgementRangesChunk{
+		FlowID:                f.id,
+		BufferBlocksAvailable: vlu.Vlu(available),
+		CumulativeAck:         f.delivered,
+		Ranges:                ackRanges(f.delivered, seqs),
+	}
+
+	bitmap := &chunks.DataAcknowledgementBitmapChunk{
+		FlowID:                f.id,
+		BufferBlocksAvailable: vlu.Vlu(available),
+		CumulativeAck:         f.delivered,
+	}
+
+	// Bitmap grows with the highest sequence number, so it's built only when it's the smaller one
+	if uint64(bitmap.Len())+ackBitmapLen(f.delivered, seqs) > uint64(ranges.Len()) {
+		return ranges
+	}
+
+	bitmap.Acknowledgement = ackBitmap(f.delivered, seqs)
+
+	return bitmap
+}
+
+// bufferAvailable returns number of free receive buffer blocks. Only data the reader
+// can drain is counted, message being reassembled would close the window for good.
+func (f *ReceiveFlow) bufferAvailable() int {
+	if buffered := f.bufferedBytes(); buffered < f.bufferSize {
+		return (f.bufferSize - buffered) / BufferBlockSize
+	}
+
+	return 0
+}
+
+// bufferedBytes returns size of the messages ready to be read and fragments received out of order
+func (f *ReceiveFlow) bufferedBytes() int {
+	buffered := f.readyBytes()
+	for _, chnk := range f.fragments {
+		buffered += len(chnk.UserData)
+	}
+
+	return buffered
+}
+
+// readyBytes returns size of the complete messages waiting to be read,
+// message being reassembled isn't counted as it can't be read yet
+func (f *ReceiveFlow) readyBytes() int {
+	ready := 0
+	for e := f.messages.Front(); e != nil; e = e.Next() {
+		ready += len(e.Value.([]byte))
+	}
+
+	return ready
+}
+
+// ackBitmap sets bit per received sequence number starting at cumulative ack + 2,
+// least significant bit of the first byte goes first
+func ackBitmap(cumAck vlu.Vlu, seqs []vlu.Vlu) []byte {
+	bitmap := make([]byte, ackBitmapLen(cumAck, seqs))
+
+	for _, seq := range seqs {
+		bit := int(seq - cumAck - 2)
+		bitmap[bit/8] |= 1 << uint(bit%8)
+	}
+
+	return bitmap
+}
+
+// ackBitmapLen returns size of the bitmap of sorted sequence numbers above cumulative ack
+func ackBitmapLen(cumAck vlu.Vlu, seqs []vlu.Vlu) uint64 {
+	if len(seqs) == 0 {
+		return 0
+	}
+
+	bits := uint64(seqs[len(seqs)-1] - cumAck - 1)
+	return (bits + 7) / 8
+}
+
+// ackRanges encodes received sequence numbers as runs of holes and received fragments
+func ackRanges(cumAck vlu.Vlu, seqs []vlu.Vlu) []chunks.DataAcknowledgementRange {
+	ranges := make([]chunks.DataAcknowledgementRange, 0)
+
+	last := cumAck // The last sequence number of the previous range
+	for i := 0; i < len(seqs); {
+		start := seqs[i]
+
+		j := i + 1
+		for j < len(seqs) && seqs[j] == seqs[j-1]+1 {
+			j++
+		}
+
+		ranges = append(ranges, chunks.DataAcknowledgementRange{
+			HolesMinusOne:    start - last - 2,
+			ReceivedMinusOne: vlu.Vlu(j-i) - 1,
+		})
+
+		last = seqs[j-1]
+		i = j
+	}
+
+	return ranges
+}
+
+// ackSet is a set of acknowledged sequence numbers
+type ackSet struct {
+	flowID       vlu.Vlu
+	bufferBlocks vlu.Vlu
+	cumAck       vlu.Vlu
+	ranges       []seqRange
+}
+
+type seqRange struct {
+	first vlu.Vlu
+	last  vlu.Vlu
+}
+
+func (set *ackSet) contains(seq vlu.Vlu) bool {
+	if seq <= set.cumAck {
+		return true
+	}
+
+	for _, r := range set.ranges {
+		if seq >= r.first && seq <= r.last {
+			return true
+		}
+	}
+
+	return false
+}
+
+// decodeAck converts either of acknowledgement encodings into a set
+func decodeAck(ack AckChunk) (*ackSet, error) {
+	switch chnk := ack.(type) {
+	case *chunks.DataAcknowledgementBitmapChunk:
+		set := &ackSet{
+			flowID:       chnk.FlowID,
+			bufferBlocks: chnk.BufferBlocksAvailable,
+			cumAck:       chnk.CumulativeAck,
+			ranges:       make([]seqRange, 0),
+		}
+
+		for i, b := range chnk.Acknowledgement {
+			for bit := uint(0); bit < 8; bit++ {
+				if b&(1<<bit) == 0 {
+					continue
+				}
+
+				seq := chnk.CumulativeAck + 2 + vlu.Vlu(i*8) + vlu.Vlu(bit)
+				if n := len(set.ranges); n > 0 && set.ranges[n-1].last+1 == seq {
+					set.ranges[n-1].last = seq
+				} else {
+					set.ranges = append(set.ranges, seqRange{first: seq, last: seq})
+				}
+			}
+		}
+
+		return set, nil
+
+	case *chunks.DataAcknowledgementRangesChunk:
+		set := &ackSet{
+			flowID:       chnk.FlowID,
+			bufferBlocks: chnk.BufferBlocksAvailable,
+			cumAck:       chnk.CumulativeAck,
+			ranges:       make([]seqRange, 0, len(chnk.Ranges)),
+		}
+
+		last := chnk.CumulativeAck
+		for _, r := range chnk.Ranges {
+			first := last + r.HolesMinusOne + 2
+			last = first + r.ReceivedMinusOne
+
+			set.ranges = append(set.ranges, seqRange{first: first, last: last})
+		}
+
+		return set, nil
+	}
+
+	return nil, errors.New("Unknown acknowledgement chunk")
+}
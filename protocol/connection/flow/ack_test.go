@@ -0,0 +1,275 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package flow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rtmfpew/amfy/vlu"
+	"github.com/rtmfpew/rtmfpew/protocol/chunks"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func fragments(f *SendFlow, n int) []*chunks.UserDataChunk {
+	for i := 0; i < n; i++ {
+		f.Write([]byte{byte(i)})
+	}
+
+	chnks := make([]*chunks.UserDataChunk, 0, n)
+	for chnk := f.NextChunk(); chnk != nil; chnk = f.NextChunk() {
+		chnks = append(chnks, chnk)
+	}
+
+	return chnks
+}
+
+func TestReceiveFlowAcknowledgement(t *testing.T) {
+	Convey("Given a receive flow", t, func() {
+		send := NewSendFlow(vlu.Vlu(7), 16)
+		recv := NewReceiveFlow(vlu.Vlu(7))
+		recv.SetBufferSize(8 * BufferBlockSize)
+
+		chnks := fragments(send, 40)
+
+		Convey("It shouldn't need ack until data is received", func() {
+			pending, immediate := recv.NeedsAck()
+			So(pending, ShouldBeFalse)
+			So(immediate, ShouldBeFalse)
+		})
+
+		Convey("In order fragments should be acked cumulatively with delay", func() {
+			recv.Receive(chnks[0])
+			recv.Receive(chnks[1])
+
+			pending, immediate := recv.NeedsAck()
+			So(pending, ShouldBeTrue)
+			So(immediate, ShouldBeFalse)
+
+			ack, ok := recv.Acknowledgement().(*chunks.DataAcknowledgementBitmapChunk)
+			So(ok, ShouldBeTrue)
+			So(ack.FlowID, ShouldEqual, 7)
+			So(ack.CumulativeAck, ShouldEqual, 2)
+			So(len(ack.Acknowledgement), ShouldEqual, 0)
+			So(ack.BufferBlocksAvailable, ShouldEqual, 7)
+
+			pending, _ = recv.NeedsAck()
+			So(pending, ShouldBeFalse)
+		})
+
+		Convey("Out of order fragments should be acked right away", func() {
+			recv.Receive(chnks[0])
+			recv.Receive(chnks[2])
+
+			_, immediate := recv.NeedsAck()
+			So(immediate, ShouldBeTrue)
+		})
+
+		Convey("Duplicates should be acked right away", func() {
+			recv.Receive(chnks[0])
+			recv.Acknowledgement()
+			recv.Receive(chnks[0])
+
+			_, immediate := recv.NeedsAck()
+			So(immediate, ShouldBeTrue)
+		})
+
+		Convey("Scattered holes should be encoded as bitmap", func() {
+			recv.Receive(chnks[0])
+			for i := 2; i < 12; i += 2 {
+				recv.Receive(chnks[i])
+			}
+
+			ack, ok := recv.Acknowledgement().(*chunks.DataAcknowledgementBitmapChunk)
+			So(ok, ShouldBeTrue)
+			So(ack.CumulativeAck, ShouldEqual, 1)
+
+			// 3, 5, 7, 9 and 11 are received starting at cumulative ack + 2
+			So(ack.Acknowledgement, ShouldResemble, []byte{0x55, 0x01})
+		})
+
+		Convey("Fragment far ahead of the forward sequence number should be dropped unacknowledged", func() {
+			recv.Receive(&chunks.UserDataChunk{
+				FlowID:          vlu.Vlu(7),
+				SequenceNumber:  vlu.Vlu(1 << 40),
+				FsnOffset:       vlu.Vlu(1 << 40),
+				FragmentControl: chunks.WholeFragmentControl,
+				UserData:        []byte{0x01},
+			})
+
+			pending, _ := recv.NeedsAck()
+			So(pending, ShouldBeFalse)
+		})
+
+		Convey("Distant fragment should be acked with ranges without building bitmap", func() {
+			recv.Receive(chnks[0])
+			recv.Receive(&chunks.UserDataChunk{
+				FlowID:          vlu.Vlu(7),
+				SequenceNumber:  vlu.Vlu(maxSequenceGap),
+				FsnOffset:       vlu.Vlu(maxSequenceGap - 1),
+				FragmentControl: chunks.WholeFragmentControl,
+				UserData:        []byte{0x01},
+			})
+
+			ack, ok := recv.Acknowledgement().(*chunks.DataAcknowledgementRangesChunk)
+			So(ok, ShouldBeTrue)
+			So(ack.Ranges, ShouldResemble, []chunks.DataAcknowledgementRange{
+				{HolesMinusOne: maxSequenceGap - 3, ReceivedMinusOne: 0},
+			})
+		})
+
+		Convey("Long runs should be encoded as ranges", func() {
+			recv.Receive(chnks[0])
+			for i := 30; i < 40; i++ {
+				recv.Receive(chnks[i])
+			}
+
+			ack, ok := recv.Acknowledgement().(*chunks.DataAcknowledgementRangesChunk)
+			So(ok, ShouldBeTrue)
+			So(ack.CumulativeAck, ShouldEqual, 1)
+			So(ack.Ranges, ShouldResemble, []chunks.DataAcknowledgementRange{
+				{HolesMinusOne: 28, ReceivedMinusOne: 9},
+			})
+		})
+
+		Convey("Chosen encoding should never be longer than the other", func() {
+			recv.Receive(chnks[0])
+			recv.Receive(chnks[3])
+			recv.Receive(chnks[4])
+			recv.Receive(chnks[20])
+
+			ack := recv.Acknowledgement()
+
+			bitmap := &chunks.DataAcknowledgementBitmapChunk{
+				FlowID:          7,
+				CumulativeAck:   1,
+				Acknowledgement: ackBitmap(1, []vlu.Vlu{4, 5, 21}),
+			}
+			ranges := &chunks.DataAcknowledgementRangesChunk{
+				FlowID:        7,
+				CumulativeAck: 1,
+				Ranges:        ackRanges(1, []vlu.Vlu{4, 5, 21}),
+			}
+
+			So(ranges.Ranges, ShouldResemble, []chunks.DataAcknowledgementRange{
+				{HolesMinusOne: 1, ReceivedMinusOne: 1},
+				{HolesMinusOne: 14, ReceivedMinusOne: 0},
+			})
+			So(ack.Len(), ShouldBeLessThanOrEqualTo, bitmap.Len())
+			So(ack.Len(), ShouldBeLessThanOrEqualTo, ranges.Len())
+		})
+
+		Convey("Buffered data should shrink available blocks", func() {
+			big := NewSendFlow(vlu.Vlu(7), 4*BufferBlockSize)
+			big.Write(make([]byte, 4*BufferBlockSize))
+			recv.Receive(big.NextChunk())
+
+			ack := recv.Acknowledgement().(*chunks.DataAcknowledgementBitmapChunk)
+			So(ack.BufferBlocksAvailable, ShouldEqual, 4)
+		})
+
+		Convey("Message being reassembled shouldn't shrink available blocks", func() {
+			big := NewSendFlow(vlu.Vlu(7), BufferBlockSize)
+			big.Write(make([]byte, 16*BufferBlockSize))
+
+			recv.Receive(big.NextChunk())
+			big.NextChunk()
+			recv.Receive(big.NextChunk())
+
+			ack := recv.Acknowledgement().(*chunks.DataAcknowledgementBitmapChunk)
+			So(ack.BufferBlocksAvailable, ShouldEqual, 7)
+		})
+	})
+}
+
+func TestFlowControl(t *testing.T) {
+	Convey("Given a send flow and a receive flow with small buffer", t, func() {
+		send := NewSendFlow(vlu.Vlu(7), BufferBlockSize)
+		recv := NewReceiveFlow(vlu.Vlu(7))
+		recv.SetBufferSize(2 * BufferBlockSize)
+
+		send.Write(make([]byte, BufferBlockSize))
+		send.Write(make([]byte, BufferBlockSize))
+		for chnk := send.NextChunk(); chnk != nil; chnk = send.NextChunk() {
+			recv.Receive(chnk)
+		}
+
+		_, _, err := send.HandleAck(recv.Acknowledgement())
+		So(err, ShouldBeNil)
+
+		send.Write(make([]byte, BufferBlockSize))
+		send.Write(make([]byte, BufferBlockSize))
+
+		Convey("Sender should stop when receive window is closed", func() {
+			So(send.Window(), ShouldEqual, 0)
+			So(send.Pending(), ShouldBeGreaterThan, 0)
+			So(send.NextChunk(), ShouldBeNil)
+		})
+
+		Convey("Sender should probe closed window periodically", func() {
+			now := time.Now()
+			So(send.NeedsProbe(now, time.Second), ShouldBeTrue)
+			So(send.NeedsProbe(now.Add(time.Millisecond), time.Second), ShouldBeFalse)
+			So(send.NeedsProbe(now.Add(time.Second), time.Second), ShouldBeTrue)
+		})
+
+		Convey("Probe should be answered right away", func() {
+			recv.HandleProbe()
+
+			pending, immediate := recv.NeedsAck()
+			So(pending, ShouldBeTrue)
+			So(immediate, ShouldBeTrue)
+		})
+
+		Convey("Lost fragment should be retransmitted while window is closed", func() {
+			lossy := NewSendFlow(vlu.Vlu(8), BufferBlockSize)
+			small := NewReceiveFlow(vlu.Vlu(8))
+			small.SetBufferSize(BufferBlockSize)
+
+			lossy.Write(make([]byte, BufferBlockSize))
+			lossy.Write(make([]byte, BufferBlockSize))
+			lossy.NextChunk()
+			small.Receive(lossy.NextChunk())
+
+			lossy.HandleAck(small.Acknowledgement())
+			So(lossy.Window(), ShouldEqual, 0)
+
+			lossy.Write(make([]byte, BufferBlockSize))
+			So(lossy.Retransmit(1), ShouldBeTrue)
+
+			chnk := lossy.NextChunk()
+			So(chnk, ShouldNotBeNil)
+			So(chnk.SequenceNumber, ShouldEqual, 1)
+			So(lossy.NextChunk(), ShouldBeNil)
+		})
+
+		Convey("Reader should reopen the window", func() {
+			_, err := recv.ReadMessage()
+			So(err, ShouldBeNil)
+
+			_, immediate := recv.NeedsAck()
+			So(immediate, ShouldBeTrue)
+
+			send.HandleAck(recv.Acknowledgement())
+			So(send.Window(), ShouldEqual, BufferBlockSize)
+			So(send.NeedsProbe(time.Now(), time.Second), ShouldBeFalse)
+			So(send.NextChunk(), ShouldNotBeNil)
+			So(send.NextChunk(), ShouldBeNil)
+		})
+	})
+}
@@ -15,3 +15,30 @@
 //
 
 package flow
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rtmfpew/amfy/vlu"
+)
+
+// Flow is a unidirectional sequence of user messages within a session
+type Flow interface {
+	ID() vlu.Vlu
+}
+
+// Flow errors
+var (
+	ErrFlowClosed   = errors.New("Flow is closed")
+	ErrFlowMismatch = errors.New("Chunk belongs to another flow")
+)
+
+// FlowException is returned by the flow rejected by the far end
+type FlowException struct {
+	Code vlu.Vlu
+}
+
+func (err *FlowException) Error() string {
+	return fmt.Sprintf("Flow is rejected with exception %d", err.Code)
+}
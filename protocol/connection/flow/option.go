@@ -0,0 +1,83 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package flow
+
+import (
+	"bytes"
+
+	"github.com/rtmfpew/amfy/vlu"
+	"github.com/rtmfpew/rtmfpew/protocol/chunks"
+)
+
+// PerFlowMetadata returns option with metadata of the new flow
+func PerFlowMetadata(metadata []byte) chunks.UserDataOption {
+	return chunks.UserDataOption{
+		OptionType: chunks.PerFlowMetadataOptionType,
+		Value:      metadata,
+	}
+}
+
+// ReturnFlowAssociation returns option opening flow in return to the far end flow ID
+func ReturnFlowAssociation(ID vlu.Vlu) chunks.UserDataOption {
+	buffer := bytes.NewBuffer(make([]byte, 0, ID.ByteLength()))
+	ID.WriteTo(buffer)
+
+	return chunks.UserDataOption{
+		OptionType: chunks.ReturnFlowAssociationOptionType,
+		Value:      buffer.Bytes(),
+	}
+}
+
+// findOption returns value of the first option of the type
+func findOption(options []chunks.UserDataOption, typ vlu.Vlu) ([]byte, bool) {
+	for _, opt := range options {
+		if opt.OptionType == typ {
+			return opt.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+// returnFlowID decodes return flow association option
+func returnFlowID(options []chunks.UserDataOption) (vlu.Vlu, bool) {
+	value, ok := findOption(options, chunks.ReturnFlowAssociationOptionType)
+	if !ok {
+		return 0, false
+	}
+
+	ID := vlu.Vlu(0)
+	if err := ID.ReadFrom(bytes.NewBuffer(value)); err != nil {
+		return 0, false
+	}
+
+	return ID, true
+}
+
+// optionsLength returns length of the options list with the marker
+func optionsLength(options []chunks.UserDataOption) int {
+	if len(options) == 0 {
+		return 0
+	}
+
+	length := 1
+	for _, opt := range options {
+		length += opt.Length()
+	}
+
+	return length
+}
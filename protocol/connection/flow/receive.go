@@ -0,0 +1,421 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package flow
+
+import (
+	"container/list"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/rtmfpew/amfy/vlu"
+	"github.com/rtmfpew/rtmfpew/config"
+	"github.com/rtmfpew/rtmfpew/protocol/chunks"
+)
+
+// maxSequenceGap is how far ahead of the forward sequence number fragments
+// are accepted, it bounds reordering state and acknowledgement size
+const maxSequenceGap = 4096
+
+// ReceiveFlow reorders user data fragments and delivers
+// complete messages in sequence. Each Read returns a single message.
+type ReceiveFlow struct {
+	id vlu.Vlu
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	delivered vlu.Vlu // All fragments up to it are consumed
+	fragments map[vlu.Vlu]*chunks.UserDataChunk
+	partial   [][]byte // Fragments of the message being reassembled
+	messages  *list.List
+	finished  bool // Final fragment is consumed
+	closed    bool // Received data is discarded
+
+	exception *FlowException // Rejection reported to the sender
+	options   []chunks.UserDataOption
+
+	bufferSize   int  // Receive buffer advertised to the sender
+	windowClosed bool // The last acknowledgement advertised no buffer
+
+	ackPending bool
+	ackNow     bool // Fragments are out of order or duplicated
+}
+
+// NewReceiveFlow creates flow for the far end flow ID
+func NewReceiveFlow(ID vlu.Vlu) *ReceiveFlow {
+	f := &ReceiveFlow{
+		id:         ID,
+		fragments:  make(map[vlu.Vlu]*chunks.UserDataChunk),
+		messages:   list.New(),
+		bufferSize: config.ReceiveBufferSize(),
+	}
+
+	f.cond = sync.NewCond(&f.mu)
+
+	return f
+}
+
+// ID returns flow ID
+func (f *ReceiveFlow) ID() vlu.Vlu {
+	return f.id
+}
+
+// Receive buffers fragment and reassembles messages available in sequence
+func (f *ReceiveFlow) Receive(chnk *chunks.UserDataChunk) error {
+	if chnk.FlowID != f.id {
+		return ErrFlowMismatch
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fsn := f.delivered
+	if chnk.FsnOffset <= chnk.SequenceNumber && chnk.SequenceNumber-chnk.FsnOffset > fsn {
+		fsn = chnk.SequenceNumber - chnk.FsnOffset
+	}
+
+	if chnk.SequenceNumber > fsn && chnk.SequenceNumber-fsn > maxSequenceGap {
+		return nil // Dropped unacknowledged, it's retransmitted once the gap is filled
+	}
+
+	if f.finished || chnk.SequenceNumber <= f.delivered || f.fragments[chnk.SequenceNumber] != nil {
+		f.ackPending = true
+		f.ackNow = true
+
+		if !f.finished && f.skipTo(fsn) { // Duplicate may still move forward sequence number
+			f.cond.Broadcast()
+		}
+
+		return nil
+	}
+
+	if !f.fits(chnk) {
+		return nil // Sender exceeded advertised buffer, fragment is dropped unacknowledged
+	}
+
+	f.ackPending = true
+
+	if f.options == nil && len(chnk.Options) > 0 {
+		f.options = chnk.Options
+	}
+
+	if chnk.SequenceNumber != f.delivered+1 {
+		f.ackNow = true
+	}
+
+	f.fragments[chnk.SequenceNumber] = chnk
+
+	delivered := f.skipTo(fsn)
+	if f.reassemble() || delivered {
+		f.cond.Broadcast()
+	}
+
+	return nil
+}
+
+// fits tells if fragment fits into the receive buffer. The next fragment
+// in sequence is limited by messages waiting to be read only, so fragments
+// received out of order can't hold the buffer forever. It's always accepted
+// while a message is reassembled or nothing is left to read, message larger
+// than the buffer can't be completed otherwise.
+func (f *ReceiveFlow) fits(chnk *chunks.UserDataChunk) bool {
+	if len(chnk.UserData) == 0 {
+		return true
+	}
+
+	if chnk.SequenceNumber != f.delivered+1 {
+		return f.bufferedBytes()+len(chnk.UserData) <= f.bufferSize
+	}
+
+	return f.partial != nil || f.messages.Len() == 0 ||
+		f.readyBytes()+len(chnk.UserData) <= f.bufferSize
+}
+
+// skipTo consumes fragments up to forward sequence number,
+// missing ones are abandoned by the sender
+func (f *ReceiveFlow) skipTo(fsn vlu.Vlu) bool {
+	if fsn <= f.delivered {
+		return false
+	}
+
+	seqs := make([]vlu.Vlu, 0)
+	for seq := range f.fragments {
+		if seq <= fsn {
+			seqs = append(seqs, seq)
+		}
+	}
+
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	delivered := false
+	for _, seq := range seqs {
+		if f.finished {
+			return true
+		}
+
+		if seq != f.delivered+1 {
+			f.partial = nil // Message with abandoned fragments
+		}
+
+		chnk := f.fragments[seq]
+		delete(f.fragments, seq)
+
+		delivered = f.consume(chnk) || delivered
+	}
+
+	if f.delivered < fsn {
+		f.partial = nil
+		f.delivered = fsn
+	}
+
+	return delivered
+}
+
+// reassemble consumes fragments available in sequence
+func (f *ReceiveFlow) reassemble() bool {
+	delivered := false
+
+	for chnk := f.fragments[f.delivered+1]; chnk != nil && !f.finished; chnk = f.fragments[f.delivered+1] {
+		delete(f.fragments, chnk.SequenceNumber)
+		delivered = f.consume(chnk) || delivered
+	}
+
+	return delivered
+}
+
+// consume adds the next fragment to the message being reassembled,
+// returns true if message is complete or flow is finished
+func (f *ReceiveFlow) consume(chnk *chunks.UserDataChunk) bool {
+	f.delivered = chnk.SequenceNumber
+
+	if chnk.Final {
+		f.finished = true
+		f.fragments = make(map[vlu.Vlu]*chunks.UserDataChunk)
+	}
+
+	if chnk.Abandon || f.closed {
+		f.partial = nil
+		return chnk.Final
+	}
+
+	switch chnk.FragmentControl {
+	case chunks.WholeFragmentControl:
+		f.partial = nil
+		f.messages.PushBack(chnk.UserData)
+		return true
+
+	case chunks.BeginFragmentControl:
+		f.partial = [][]byte{chnk.UserData}
+
+	case chunks.MiddleFragmentControl:
+		if f.partial != nil {
+			f.partial = append(f.partial, chnk.UserData)
+		}
+
+	case chunks.EndFragmentControl:
+		if f.partial != nil {
+			f.messages.PushBack(join(append(f.partial, chnk.UserData)))
+			f.partial = nil
+			return true
+		}
+	}
+
+	return chnk.Final
+}
+
+// Options returns options the far end opened flow with
+func (f *ReceiveFlow) Options() []chunks.UserDataOption {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.options
+}
+
+// Metadata returns metadata the far end opened flow with or nil
+func (f *ReceiveFlow) Metadata() []byte {
+	metadata, _ := findOption(f.Options(), chunks.PerFlowMetadataOptionType)
+	return metadata
+}
+
+// ReturnFlowID returns ID of the near end flow this one is returned for
+func (f *ReceiveFlow) ReturnFlowID() (vlu.Vlu, bool) {
+	return returnFlowID(f.Options())
+}
+
+// ReadMessage blocks until the next message is available.
+// io.EOF is returned once the final message is read.
+func (f *ReceiveFlow) ReadMessage() ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for f.messages.Len() == 0 {
+		if f.closed {
+			return nil, ErrFlowClosed
+		}
+
+		if f.finished {
+			return nil, io.EOF
+		}
+
+		f.cond.Wait()
+	}
+
+	msg := f.messages.Remove(f.messages.Front()).([]byte)
+	f.reopenWindow()
+
+	return msg, nil
+}
+
+// SetBufferSize sets receive buffer advertised to the sender, it limits
+// how much data the sender can transmit ahead of the reader
+func (f *ReceiveFlow) SetBufferSize(size int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.bufferSize = size
+	f.reopenWindow()
+}
+
+// BufferSize returns receive buffer advertised to the sender
+func (f *ReceiveFlow) BufferSize() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.bufferSize
+}
+
+// HandleProbe makes the next acknowledgement advertise available buffer immediately
+func (f *ReceiveFlow) HandleProbe() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.ackPending = true
+	f.ackNow = true
+}
+
+// reopenWindow acknowledges immediately once buffer is freed after it was advertised full
+func (f *ReceiveFlow) reopenWindow() {
+	if f.windowClosed && f.bufferAvailable() > 0 {
+		f.ackPending = true
+		f.ackNow = true
+	}
+}
+
+// Read reads the next message into p, message is left
+// in the flow with io.ErrShortBuffer if p is too short
+func (f *ReceiveFlow) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for f.messages.Len() == 0 {
+		if f.closed {
+			return 0, ErrFlowClosed
+		}
+
+		if f.finished {
+			return 0, io.EOF
+		}
+
+		f.cond.Wait()
+	}
+
+	msg := f.messages.Front().Value.([]byte)
+	if len(msg) > len(p) {
+		return 0, io.ErrShortBuffer
+	}
+
+	f.messages.Remove(f.messages.Front())
+	f.reopenWindow()
+
+	return copy(p, msg), nil
+}
+
+// Buffered returns number of messages ready to be read
+func (f *ReceiveFlow) Buffered() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.messages.Len()
+}
+
+// Finished returns true once the final fragment is received in sequence
+func (f *ReceiveFlow) Finished() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.finished
+}
+
+// Close stops delivery, pending readers are unblocked.
+// Received data is still acknowledged and discarded.
+func (f *ReceiveFlow) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.close()
+}
+
+func (f *ReceiveFlow) close() error {
+	if f.closed {
+		return ErrFlowClosed
+	}
+
+	f.closed = true
+	f.partial = nil
+	f.messages.Init()
+	f.cond.Broadcast()
+
+	return nil
+}
+
+// Reject closes flow and reports exception code to the sender
+func (f *ReceiveFlow) Reject(code vlu.Vlu) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.close(); err != nil {
+		return err
+	}
+
+	f.exception = &FlowException{Code: code}
+	f.ackPending = true
+	f.ackNow = true
+
+	return nil
+}
+
+// Exception returns rejection of the flow or nil
+func (f *ReceiveFlow) Exception() *FlowException {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.exception
+}
+
+func join(fragments [][]byte) []byte {
+	length := 0
+	for _, fragment := range fragments {
+		length += len(fragment)
+	}
+
+	msg := make([]byte, 0, length)
+	for _, fragment := range fragments {
+		msg = append(msg, fragment...)
+	}
+
+	return msg
+}
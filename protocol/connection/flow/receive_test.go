@@ -0,0 +1,389 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package flow
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/rtmfpew/amfy/vlu"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReceiveFlow(t *testing.T) {
+	Convey("Given a send flow and a receive flow", t, func() {
+		send := NewSendFlow(vlu.Vlu(5), 2)
+		recv := NewReceiveFlow(vlu.Vlu(5))
+
+		Convey("Messages should be delivered in order", func() {
+			send.Write([]byte{0x01, 0x02, 0x03})
+			send.Write([]byte{0x04})
+
+			for chnk := send.NextChunk(); chnk != nil; chnk = send.NextChunk() {
+				So(recv.Receive(chnk), ShouldBeNil)
+			}
+
+			msg, err := recv.ReadMessage()
+			So(err, ShouldBeNil)
+			So(msg, ShouldResemble, []byte{0x01, 0x02, 0x03})
+
+			p := make([]byte, 8)
+			n, err := recv.Read(p)
+			So(err, ShouldBeNil)
+			So(p[:n], ShouldResemble, []byte{0x04})
+		})
+
+		Convey("Out of order fragments should be reordered", func() {
+			send.Write([]byte{0x01, 0x02, 0x03, 0x04, 0x05})
+			send.Write([]byte{0x06})
+
+			first := send.NextChunk()
+			second := send.NextChunk()
+			third := send.NextChunk()
+			fourth := send.NextChunk()
+
+			recv.Receive(fourth)
+			recv.Receive(second)
+			So(recv.Buffered(), ShouldEqual, 0)
+
+			recv.Receive(third)
+			recv.Receive(second)
+			So(recv.Buffered(), ShouldEqual, 0)
+
+			recv.Receive(first)
+			So(recv.Buffered(), ShouldEqual, 2)
+
+			msg, _ := recv.ReadMessage()
+			So(msg, ShouldResemble, []byte{0x01, 0x02, 0x03, 0x04, 0x05})
+
+			msg, _ = recv.ReadMessage()
+			So(msg, ShouldResemble, []byte{0x06})
+		})
+
+		Convey("Short read buffer should keep the message", func() {
+			send.Write([]byte{0x01, 0x02})
+			recv.Receive(send.NextChunk())
+
+			_, err := recv.Read(make([]byte, 1))
+			So(err, ShouldEqual, io.ErrShortBuffer)
+			So(recv.Buffered(), ShouldEqual, 1)
+		})
+
+		Convey("Final fragment should end the flow", func() {
+			send.Write([]byte{0x01})
+			send.Close()
+
+			recv.Receive(send.NextChunk())
+			So(recv.Finished(), ShouldBeTrue)
+
+			msg, err := recv.ReadMessage()
+			So(err, ShouldBeNil)
+			So(msg, ShouldResemble, []byte{0x01})
+
+			_, err = recv.ReadMessage()
+			So(err, ShouldEqual, io.EOF)
+		})
+
+		Convey("Read should block until message arrives", func() {
+			send.Write([]byte{0x01})
+
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				recv.Receive(send.NextChunk())
+			}()
+
+			msg, err := recv.ReadMessage()
+			So(err, ShouldBeNil)
+			So(msg, ShouldResemble, []byte{0x01})
+		})
+
+		Convey("Close should unblock readers", func() {
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				recv.Close()
+			}()
+
+			_, err := recv.ReadMessage()
+			So(err, ShouldEqual, ErrFlowClosed)
+		})
+
+		Convey("Fragments beyond receive buffer should be dropped unacknowledged", func() {
+			recv.SetBufferSize(4)
+			for i := 0; i < 3; i++ {
+				send.Write([]byte{byte(i), byte(i)})
+			}
+
+			first, second, third := send.NextChunk(), send.NextChunk(), send.NextChunk()
+			recv.Receive(first)
+			recv.Receive(second)
+			recv.Acknowledgement()
+
+			recv.Receive(third)
+			So(recv.Buffered(), ShouldEqual, 2)
+
+			pending, _ := recv.NeedsAck()
+			So(pending, ShouldBeFalse)
+
+			recv.ReadMessage()
+			recv.Receive(third)
+			So(recv.Buffered(), ShouldEqual, 2)
+		})
+
+		Convey("Out of order fragments shouldn't hold the buffer from the next one in sequence", func() {
+			recv.SetBufferSize(4)
+			for i := 0; i < 4; i++ {
+				send.Write([]byte{byte(i), byte(i)})
+			}
+
+			first, second, third, fourth := send.NextChunk(), send.NextChunk(), send.NextChunk(), send.NextChunk()
+			recv.Receive(second)
+			recv.Receive(third)
+			recv.Receive(fourth)
+
+			recv.Receive(first)
+			So(recv.Buffered(), ShouldEqual, 3)
+		})
+
+		Convey("Message larger than receive buffer should be delivered", func() {
+			send := NewSendFlow(vlu.Vlu(5), BufferBlockSize)
+			recv.SetBufferSize(4 * BufferBlockSize)
+
+			send.Write([]byte("hello"))
+			large := bytes.Repeat([]byte{0x01}, 10*BufferBlockSize)
+			send.Write(large)
+
+			for i := 0; i < 100 && recv.Buffered() < 2; i++ {
+				for chnk := send.NextChunk(); chnk != nil; chnk = send.NextChunk() {
+					So(recv.Receive(chnk), ShouldBeNil)
+				}
+
+				_, _, err := send.HandleAck(recv.Acknowledgement())
+				So(err, ShouldBeNil)
+			}
+
+			So(recv.Buffered(), ShouldEqual, 2)
+
+			msg, err := recv.ReadMessage()
+			So(err, ShouldBeNil)
+			So(msg, ShouldResemble, []byte("hello"))
+
+			msg, err = recv.ReadMessage()
+			So(err, ShouldBeNil)
+			So(msg, ShouldResemble, large)
+		})
+
+		Convey("Fragments of another flow should be rejected", func() {
+			other := NewSendFlow(vlu.Vlu(6), 2)
+			other.Write([]byte{0x01})
+
+			So(recv.Receive(other.NextChunk()), ShouldEqual, ErrFlowMismatch)
+		})
+	})
+}
+
+func TestReceiveFlowPartialReliability(t *testing.T) {
+	Convey("Given a send flow and a receive flow", t, func() {
+		send := NewSendFlow(vlu.Vlu(5), 2)
+		recv := NewReceiveFlow(vlu.Vlu(5))
+		now := time.Now()
+
+		Convey("Receiver should skip abandoned messages", func() {
+			send.WriteMessage([]byte{0x01, 0x02, 0x03}, now.Add(time.Second), UnlimitedRetransmissions)
+			send.Write([]byte{0x04})
+
+			lost := send.NextChunk()
+			So(lost.SequenceNumber, ShouldEqual, 1)
+
+			send.Abandon(now.Add(time.Second))
+
+			next := send.NextChunk()
+			So(next.SequenceNumber, ShouldEqual, 3)
+			So(next.FsnOffset, ShouldEqual, 1)
+
+			recv.Receive(next)
+			So(recv.Buffered(), ShouldEqual, 1)
+
+			msg, _ := recv.ReadMessage()
+			So(msg, ShouldResemble, []byte{0x04})
+
+			recv.Receive(lost)
+			So(recv.Buffered(), ShouldEqual, 0)
+		})
+
+		Convey("Received fragments before forward sequence number should be delivered", func() {
+			send.Write([]byte{0x01})
+			send.WriteMessage([]byte{0x02}, now.Add(time.Second), UnlimitedRetransmissions)
+			send.Write([]byte{0x03})
+
+			first := send.NextChunk()
+			send.NextChunk()
+			send.Abandon(now.Add(time.Second))
+			third := send.NextChunk()
+			third.FsnOffset = 1 // As if the first one is acknowledged
+
+			recv.Receive(first)
+			recv.Receive(third)
+			So(recv.Buffered(), ShouldEqual, 2)
+		})
+
+		Convey("Partially received abandoned message should be dropped", func() {
+			send.WriteMessage([]byte{0x01, 0x02, 0x03, 0x04, 0x05}, now.Add(time.Second), UnlimitedRetransmissions)
+			send.Write([]byte{0x06})
+
+			begin := send.NextChunk()
+			send.NextChunk()
+			send.Abandon(now.Add(time.Second))
+			next := send.NextChunk()
+			So(next.SequenceNumber, ShouldEqual, 4)
+			next.FsnOffset = 1
+
+			recv.Receive(begin)
+			recv.Receive(next)
+
+			msg, _ := recv.ReadMessage()
+			So(msg, ShouldResemble, []byte{0x06})
+			So(recv.Buffered(), ShouldEqual, 0)
+		})
+
+		Convey("Later messages should be delivered once nothing but abandoned data is left", func() {
+			send.Write([]byte{0x01})
+			send.WriteMessage([]byte{0x02}, now.Add(time.Second), UnlimitedRetransmissions)
+			send.Write([]byte{0x03})
+
+			recv.Receive(send.NextChunk())
+			send.NextChunk() // Lost
+			recv.Receive(send.NextChunk())
+
+			msg, _ := recv.ReadMessage()
+			So(msg, ShouldResemble, []byte{0x01})
+
+			send.HandleAck(recv.Acknowledgement())
+			send.Abandon(now.Add(time.Second))
+			So(send.ForwardSequenceNumber(), ShouldEqual, 3)
+			So(send.Outstanding(), ShouldEqual, 0)
+			So(send.Pending(), ShouldEqual, 1)
+
+			update := send.NextChunk()
+			So(update.SequenceNumber, ShouldEqual, 3)
+			So(update.FsnOffset, ShouldEqual, 0)
+			So(update.Abandon, ShouldBeTrue)
+			So(len(update.UserData), ShouldEqual, 0)
+			So(send.NextChunk(), ShouldBeNil)
+
+			recv.Receive(update)
+			So(recv.Buffered(), ShouldEqual, 1)
+
+			msg, _ = recv.ReadMessage()
+			So(msg, ShouldResemble, []byte{0x03})
+
+			Convey("Update should be sent again until it's acknowledged", func() {
+				send.Timeout(time.Now().Add(time.Second), time.Second)
+				So(send.Pending(), ShouldEqual, 1)
+
+				send.HandleAck(recv.Acknowledgement())
+				send.Timeout(time.Now().Add(time.Second), time.Second)
+				So(send.Pending(), ShouldEqual, 0)
+			})
+		})
+
+		Convey("Abandoned final fragment should finish the flow", func() {
+			send.WriteMessage([]byte{0x01}, now.Add(time.Second), UnlimitedRetransmissions)
+			send.Close()
+			send.Abandon(now.Add(time.Second))
+
+			recv.Receive(send.NextChunk())
+			So(recv.Finished(), ShouldBeTrue)
+
+			_, err := recv.ReadMessage()
+			So(err, ShouldEqual, io.EOF)
+		})
+	})
+}
+
+func TestFlowException(t *testing.T) {
+	Convey("Given a send flow and a receive flow", t, func() {
+		send := NewSendFlow(vlu.Vlu(7), 2)
+		recv := NewReceiveFlow(vlu.Vlu(7))
+
+		send.Write([]byte{0x01, 0x02, 0x03})
+		recv.Receive(send.NextChunk())
+
+		Convey("Rejected flow should report exception with acknowledgement", func() {
+			So(recv.Reject(vlu.Vlu(42)), ShouldBeNil)
+			So(recv.Exception().Code, ShouldEqual, 42)
+
+			_, immediate := recv.NeedsAck()
+			So(immediate, ShouldBeTrue)
+
+			_, err := recv.ReadMessage()
+			So(err, ShouldEqual, ErrFlowClosed)
+		})
+
+		Convey("Rejected flow should still acknowledge data", func() {
+			recv.Reject(vlu.Vlu(42))
+			recv.Receive(send.NextChunk())
+			So(recv.Buffered(), ShouldEqual, 0)
+
+			acked, _, err := send.HandleAck(recv.Acknowledgement())
+			So(err, ShouldBeNil)
+			So(acked, ShouldEqual, 3)
+		})
+
+		Convey("Sender should abandon everything on exception", func() {
+			send.Write([]byte{0x04})
+			send.HandleException(vlu.Vlu(42))
+
+			_, err := send.Write([]byte{0x05})
+			So(err, ShouldResemble, &FlowException{Code: 42})
+			So(send.Closed(), ShouldBeTrue)
+
+			chnk := send.NextChunk()
+			So(chnk.Abandon, ShouldBeTrue)
+			So(chnk.Final, ShouldBeTrue)
+			So(send.NextChunk(), ShouldBeNil)
+
+			recv.Receive(chnk)
+			So(recv.Finished(), ShouldBeTrue)
+
+			send.HandleAck(recv.Acknowledgement())
+			So(send.Finished(), ShouldBeTrue)
+			So(send.Wait(), ShouldResemble, &FlowException{Code: 42})
+		})
+
+		Convey("Closed flow should finish once all data is acknowledged", func() {
+			send.Close()
+			So(send.Finished(), ShouldBeFalse)
+
+			done := make(chan error, 1)
+			go func() {
+				done <- send.Wait()
+			}()
+
+			recv.Receive(send.NextChunk())
+			send.HandleAck(recv.Acknowledgement())
+			So(<-done, ShouldBeNil)
+			So(recv.Finished(), ShouldBeTrue)
+
+			msg, err := recv.ReadMessage()
+			So(err, ShouldBeNil)
+			So(msg, ShouldResemble, []byte{0x01, 0x02, 0x03})
+		})
+	})
+}
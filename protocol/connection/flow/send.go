@@ -0,0 +1,819 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package flow
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/rtmfpew/amfy/vlu"
+	"github.com/rtmfpew/rtmfpew/config"
+	"github.com/rtmfpew/rtmfpew/protocol/chunks"
+)
+
+// UnlimitedRetransmissions makes messages fully reliable
+const UnlimitedRetransmissions = -1
+
+// Priority is a scheduling class of the send flow, flows of the higher
+// class are always sent before flows of the lower one
+type Priority int
+
+// Flow priorities from the lowest to the highest
+const (
+	PriorityBackground Priority = iota
+	PriorityBulk
+	PriorityData
+	PriorityRoutine
+	PriorityPriority
+	PriorityImmediate
+	PriorityFlash
+	PriorityFlashOverride
+)
+
+// message is a lifetime of the message fragments
+type message struct {
+	deadline           time.Time // Zero deadline never expires
+	maxRetransmissions int
+	abandoned          bool
+}
+
+// fragment is a user data chunk waiting to be sent or acknowledged
+type fragment struct {
+	chunk         *chunks.UserDataChunk
+	msg           *message
+	transmissions int
+	sentAt        time.Time
+	sentIndex     uint64 // Order of the last transmission
+	nacks         int    // Later sent fragments acknowledged since the last transmission
+	acked         bool
+	queued        bool
+}
+
+// lossThreshold is a number of acknowledgements of later sent fragments
+// after which fragment is considered lost
+const lossThreshold = 3
+
+// SendFlow splits written messages into user data fragments.
+// Each Write is a single message.
+type SendFlow struct {
+	// Lifetime and MaxRetransmissions are applied to messages written
+	// with Write, they should be set before writing.
+	Lifetime           time.Duration
+	MaxRetransmissions int
+
+	id           vlu.Vlu
+	fragmentSize int
+
+	mu          sync.Mutex
+	cond        *sync.Cond
+	nextSeq     vlu.Vlu    // Sequence number of the next fragment
+	fsn         vlu.Vlu    // Forward sequence number
+	queue       *list.List // Fragments waiting for (re)transmission
+	outstanding *list.List // Fragments neither acknowledged nor abandoned in sequence order
+	sent        uint64     // Number of transmissions
+	closed      bool
+	exception   error // Set when the far end rejects the flow
+
+	timeCritical bool
+	priority     Priority
+	weight       int
+
+	window  int       // Receive buffer available at the far end
+	probeAt time.Time // When to probe closed receive window
+
+	options      []chunks.UserDataOption
+	optionsAcked bool // Options are sent until the far end acknowledges anything
+
+	fsnUpdate bool      // Forward sequence number moved over abandoned data the far end doesn't know about
+	fsnSentAt time.Time // When the forward sequence number was sent the last time
+}
+
+// NewSendFlow creates flow splitting messages into fragments of at most fragmentSize bytes
+func NewSendFlow(ID vlu.Vlu, fragmentSize int) *SendFlow {
+	if fragmentSize <= 0 {
+		fragmentSize = 1
+	}
+
+	f := &SendFlow{
+		MaxRetransmissions: UnlimitedRetransmissions,
+		priority:           PriorityRoutine,
+		weight:             1,
+		id:                 ID,
+		fragmentSize:       fragmentSize,
+		nextSeq:            1,
+		queue:              list.New(),
+		outstanding:        list.New(),
+		window:             config.ReceiveBufferSize(),
+	}
+
+	f.cond = sync.NewCond(&f.mu)
+
+	return f
+}
+
+// NewSendFlowWithOptions creates flow sending options with the fragments until the far end
+// acknowledges any of them. Options are included in fragmentSize.
+func NewSendFlowWithOptions(ID vlu.Vlu, fragmentSize int, options []chunks.UserDataOption) *SendFlow {
+	f := NewSendFlow(ID, fragmentSize-optionsLength(options))
+	f.options = options
+
+	return f
+}
+
+// SetFragmentSize changes size of the fragments, options are included in fragmentSize.
+// Fragments which weren't sent yet are split again when they don't fit.
+func (f *SendFlow) SetFragmentSize(fragmentSize int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fragmentSize -= optionsLength(f.options)
+	if fragmentSize <= 0 {
+		fragmentSize = 1
+	}
+
+	f.fragmentSize = fragmentSize
+	f.refragment()
+}
+
+// refragment splits fragments which weren't sent yet to fit fragment size,
+// they follow the sent ones so they are numbered again from the first of them
+func (f *SendFlow) refragment() {
+	unsent := f.outstanding.Back()
+	oversized := false
+	for e := unsent; e != nil && e.Value.(*fragment).transmissions == 0; e = e.Prev() {
+		unsent = e
+		oversized = oversized || len(e.Value.(*fragment).chunk.UserData) > f.fragmentSize
+	}
+
+	if !oversized {
+		return
+	}
+
+	for e := f.queue.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(*fragment).transmissions == 0 {
+			f.queue.Remove(e)
+		}
+
+		e = next
+	}
+
+	split := make([]*fragment, 0)
+	for e := unsent; e != nil; {
+		next := e.Next()
+		split = append(split, f.outstanding.Remove(e).(*fragment))
+		e = next
+	}
+
+	f.nextSeq = split[0].chunk.SequenceNumber
+	for _, fr := range split {
+		first := fr.chunk.FragmentControl == chunks.WholeFragmentControl ||
+			fr.chunk.FragmentControl == chunks.BeginFragmentControl
+		last := fr.chunk.FragmentControl == chunks.WholeFragmentControl ||
+			fr.chunk.FragmentControl == chunks.EndFragmentControl
+
+		data := fr.chunk.UserData
+		for offset := 0; ; offset += f.fragmentSize {
+			end := offset + f.fragmentSize
+			if end > len(data) {
+				end = len(data)
+			}
+
+			f.push(&fragment{
+				chunk: &chunks.UserDataChunk{
+					FlowID:          f.id,
+					SequenceNumber:  f.nextSeq,
+					FragmentControl: fragmentControl(first && offset == 0, last && end == len(data)),
+					UserData:        data[offset:end],
+					Final:           fr.chunk.Final && end == len(data),
+				},
+				msg: fr.msg,
+			})
+
+			if end == len(data) {
+				break
+			}
+		}
+	}
+}
+
+// Options returns options the flow is opened with
+func (f *SendFlow) Options() []chunks.UserDataOption {
+	return f.options
+}
+
+// Metadata returns metadata the flow is opened with or nil
+func (f *SendFlow) Metadata() []byte {
+	metadata, _ := findOption(f.options, chunks.PerFlowMetadataOptionType)
+	return metadata
+}
+
+// ReturnFlowID returns ID of the far end flow this one is returned for
+func (f *SendFlow) ReturnFlowID() (vlu.Vlu, bool) {
+	return returnFlowID(f.options)
+}
+
+// ID returns flow ID
+func (f *SendFlow) ID() vlu.Vlu {
+	return f.id
+}
+
+// Write queues message p with flow lifetime and retransmissions limit
+func (f *SendFlow) Write(p []byte) (int, error) {
+	deadline := time.Time{}
+	if f.Lifetime > 0 {
+		deadline = time.Now().Add(f.Lifetime)
+	}
+
+	return f.WriteMessage(p, deadline, f.MaxRetransmissions)
+}
+
+// WriteMessage queues message p, it's abandoned if it's not delivered
+// until deadline or in maxRetransmissions retransmissions
+func (f *SendFlow) WriteMessage(p []byte, deadline time.Time, maxRetransmissions int) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.exception != nil {
+		return 0, f.exception
+	}
+
+	if f.closed {
+		return 0, ErrFlowClosed
+	}
+
+	msg := &message{
+		deadline:           deadline,
+		maxRetransmissions: maxRetransmissions,
+	}
+
+	data := make([]byte, len(p))
+	copy(data, p)
+
+	for offset := 0; ; offset += f.fragmentSize {
+		end := offset + f.fragmentSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		f.push(&fragment{
+			chunk: &chunks.UserDataChunk{
+				FlowID:          f.id,
+				SequenceNumber:  f.nextSeq,
+				FragmentControl: fragmentControl(offset == 0, end == len(data)),
+				UserData:        data[offset:end],
+			},
+			msg: msg,
+		})
+
+		if end == len(data) {
+			break
+		}
+	}
+
+	return len(p), nil
+}
+
+func (f *SendFlow) push(fr *fragment) {
+	f.nextSeq++
+	fr.queued = true
+	f.queue.PushBack(fr)
+	f.outstanding.PushBack(fr)
+}
+
+// Close marks the last message as final, empty final fragment is sent
+// when the last message is already sent. Flow is finished once
+// all the fragments are acknowledged.
+func (f *SendFlow) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return ErrFlowClosed
+	}
+
+	f.close(&message{maxRetransmissions: UnlimitedRetransmissions})
+	return nil
+}
+
+func (f *SendFlow) close(msg *message) {
+	f.closed = true
+	if back := f.queue.Back(); back != nil {
+		if fr := back.Value.(*fragment); fr.transmissions == 0 && fr.chunk.SequenceNumber == f.nextSeq-1 {
+			fr.chunk.Final = true // The last fragment isn't sent yet, it carries final flag
+			return
+		}
+	}
+
+	f.push(&fragment{
+		chunk: &chunks.UserDataChunk{
+			FlowID:          f.id,
+			SequenceNumber:  f.nextSeq,
+			FragmentControl: chunks.WholeFragmentControl,
+			Final:           true,
+		},
+		msg: msg,
+	})
+}
+
+// HandleException abandons all the messages and closes flow rejected by the far end
+func (f *SendFlow) HandleException(code vlu.Vlu) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.exception != nil {
+		return
+	}
+
+	f.exception = &FlowException{Code: code}
+
+	for e := f.outstanding.Front(); e != nil; e = e.Next() {
+		f.abandon(e.Value.(*fragment).msg)
+	}
+
+	if !f.closed {
+		f.close(&message{abandoned: true})
+	}
+
+	f.advance()
+}
+
+// Abort drops all the fragments and closes flow, writes and waits fail with err
+func (f *SendFlow) Abort(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.exception == nil {
+		f.exception = err
+	}
+
+	f.closed = true
+	f.queue.Init()
+	f.outstanding.Init()
+	f.cond.Broadcast()
+}
+
+// Finished returns true once flow is closed and all the fragments
+// are acknowledged or abandoned
+func (f *SendFlow) Finished() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.finished()
+}
+
+func (f *SendFlow) finished() bool {
+	return f.closed && f.outstanding.Len() == 0
+}
+
+// Wait blocks until flow is finished, FlowException is
+// returned if the far end rejected the flow
+func (f *SendFlow) Wait() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for !f.finished() {
+		f.cond.Wait()
+	}
+
+	return f.exception
+}
+
+// Closed returns true once flow is closed for writing
+func (f *SendFlow) Closed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.closed
+}
+
+// SetTimeCritical marks flow as carrying time critical data, like voice or video,
+// which preempts other traffic of the host
+func (f *SendFlow) SetTimeCritical(timeCritical bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.timeCritical = timeCritical
+}
+
+// TimeCritical returns true if flow carries time critical data
+func (f *SendFlow) TimeCritical() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.timeCritical
+}
+
+// SetPriority sets scheduling class of the flow
+func (f *SendFlow) SetPriority(priority Priority) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.priority = priority
+}
+
+// Priority returns scheduling class of the flow, it's PriorityRoutine by default
+func (f *SendFlow) Priority() Priority {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.priority
+}
+
+// SetWeight sets share of the flow among flows of the same priority
+func (f *SendFlow) SetWeight(weight int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if weight < 1 {
+		weight = 1
+	}
+
+	f.weight = weight
+}
+
+// Weight returns share of the flow among flows of the same priority, it's 1 by default
+func (f *SendFlow) Weight() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.weight
+}
+
+// Pending returns number of fragments waiting to be sent
+func (f *SendFlow) Pending() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.fsnUpdateDue() {
+		return f.queue.Len() + 1
+	}
+
+	return f.queue.Len()
+}
+
+// Outstanding returns number of fragments neither acknowledged nor abandoned
+func (f *SendFlow) Outstanding() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.outstanding.Len()
+}
+
+// InFlight returns number of user data bytes sent but neither acknowledged nor lost
+func (f *SendFlow) InFlight() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.inFlight()
+}
+
+func (f *SendFlow) inFlight() int {
+	inFlight := 0
+	for e := f.outstanding.Front(); e != nil; e = e.Next() {
+		if fr := e.Value.(*fragment); fr.transmissions > 0 && !fr.acked && !fr.queued {
+			inFlight += len(fr.chunk.UserData)
+		}
+	}
+
+	return inFlight
+}
+
+// Window returns receive buffer available at the far end as of the last acknowledgement
+func (f *SendFlow) Window() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.window
+}
+
+// NeedsProbe returns true when receive window of the far end is closed
+// while there are new fragments to send, and the last probe was sent interval ago
+func (f *SendFlow) NeedsProbe(now time.Time, interval time.Duration) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.window > 0 || f.inFlight() > 0 || f.queue.Len() == 0 {
+		f.probeAt = time.Time{}
+		return false
+	}
+
+	if f.probeAt.IsZero() {
+		f.probeAt = now // The first probe goes right away
+	}
+
+	if now.Before(f.probeAt) {
+		return false
+	}
+
+	f.probeAt = now.Add(interval)
+	return true
+}
+
+// ForwardSequenceNumber returns the highest sequence number
+// which fragments and all before it are acknowledged or abandoned
+func (f *SendFlow) ForwardSequenceNumber() vlu.Vlu {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.fsn
+}
+
+// NextChunk returns the next fragment to be sent or nil.
+// Fragments of abandoned messages are skipped, but the final one
+// which is sent empty with abandon flag. Empty abandoned fragment
+// at forward sequence number is sent when nothing else carries it.
+// Retransmissions go first, they aren't limited by receive window.
+func (f *SendFlow) NextChunk() *chunks.UserDataChunk {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for front := f.nextQueued(); front != nil; front = f.nextQueued() {
+		fr := front.Value.(*fragment)
+		if fr.transmissions == 0 && !fr.msg.abandoned && f.window-f.inFlight() <= 0 {
+			return f.fsnUpdateChunk() // New data waits for receive window to open
+		}
+
+		f.queue.Remove(front)
+		fr.queued = false
+
+		if fr.acked || (fr.msg.abandoned && !fr.chunk.Final) {
+			continue
+		}
+
+		f.sent++
+		fr.transmissions++
+		fr.sentAt = time.Now()
+		fr.sentIndex = f.sent
+		fr.nacks = 0
+
+		chnk := *fr.chunk
+		chnk.FsnOffset = chnk.SequenceNumber - f.fsn
+
+		if !f.optionsAcked {
+			chnk.Options = f.options
+		}
+
+		if fr.msg.abandoned {
+			chnk.Abandon = true
+			chnk.UserData = nil
+		}
+
+		if f.fsnUpdate { // Forward sequence number goes with the fragment
+			f.fsnSentAt = fr.sentAt
+		}
+
+		return &chnk
+	}
+
+	return f.fsnUpdateChunk()
+}
+
+// nextQueued returns the first queued retransmission or the front of the queue
+func (f *SendFlow) nextQueued() *list.Element {
+	for e := f.queue.Front(); e != nil; e = e.Next() {
+		if e.Value.(*fragment).transmissions > 0 {
+			return e
+		}
+	}
+
+	return f.queue.Front()
+}
+
+// fsnUpdateDue tells if forward sequence number should be sent alone
+func (f *SendFlow) fsnUpdateDue() bool {
+	return f.fsnUpdate && f.fsnSentAt.IsZero()
+}
+
+// fsnUpdateChunk returns empty abandoned fragment at forward sequence number
+// when it moved over abandoned data and no fragment is sent to carry it
+func (f *SendFlow) fsnUpdateChunk() *chunks.UserDataChunk {
+	if !f.fsnUpdateDue() {
+		return nil
+	}
+
+	f.fsnSentAt = time.Now()
+
+	chnk := &chunks.UserDataChunk{
+		FlowID:          f.id,
+		SequenceNumber:  f.fsn,
+		FragmentControl: chunks.WholeFragmentControl,
+		Abandon:         true,
+	}
+
+	if !f.optionsAcked {
+		chnk.Options = f.options
+	}
+
+	return chnk
+}
+
+// Retransmit queues outstanding fragment to be sent again.
+// Message is abandoned instead when it reached retransmissions limit.
+func (f *SendFlow) Retransmit(seq vlu.Vlu) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fr := f.find(seq)
+	if fr == nil {
+		return false
+	}
+
+	queued := f.retransmit(fr)
+	f.advance()
+
+	return queued
+}
+
+func (f *SendFlow) retransmit(fr *fragment) bool {
+	if fr.queued || fr.acked {
+		return false
+	}
+
+	limit := fr.msg.maxRetransmissions
+	if !fr.msg.abandoned && limit != UnlimitedRetransmissions && fr.transmissions > limit {
+		f.abandon(fr.msg)
+	}
+
+	if fr.msg.abandoned && !fr.chunk.Final {
+		return false
+	}
+
+	fr.queued = true
+	f.queue.PushBack(fr)
+
+	return true
+}
+
+// Abandon abandons messages which lifetime has expired, returns number of them
+func (f *SendFlow) Abandon(now time.Time) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	abandoned := 0
+	for e := f.outstanding.Front(); e != nil; e = e.Next() {
+		msg := e.Value.(*fragment).msg
+		if msg.abandoned || msg.deadline.IsZero() || now.Before(msg.deadline) {
+			continue
+		}
+
+		msg.abandoned = true
+		abandoned++
+	}
+
+	f.advance()
+
+	return abandoned
+}
+
+// HandleAck marks acknowledged fragments and retransmits fragments
+// which three later sent fragments are acknowledged.
+// Returns number of newly acknowledged user data bytes and lost fragments.
+func (f *SendFlow) HandleAck(ack AckChunk) (acked int, lost int, err error) {
+	set, err := decodeAck(ack)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if set.flowID != f.id {
+		return 0, 0, ErrFlowMismatch
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.window = int(set.bufferBlocks) * BufferBlockSize
+	f.optionsAcked = true
+
+	if set.cumAck >= f.fsn {
+		f.fsnUpdate = false
+	}
+
+	latest := uint64(0) // The last sent of acknowledged fragments
+	for e := f.outstanding.Front(); e != nil; e = e.Next() {
+		fr := e.Value.(*fragment)
+		if fr.acked || fr.transmissions == 0 || !set.contains(fr.chunk.SequenceNumber) {
+			continue
+		}
+
+		fr.acked = true
+		acked += len(fr.chunk.UserData)
+
+		if fr.sentIndex > latest {
+			latest = fr.sentIndex
+		}
+	}
+
+	for e := f.outstanding.Front(); e != nil; e = e.Next() {
+		fr := e.Value.(*fragment)
+		if fr.acked || fr.queued || fr.transmissions == 0 || fr.sentIndex > latest {
+			continue
+		}
+
+		if fr.nacks++; fr.nacks >= lossThreshold && f.retransmit(fr) {
+			lost++
+		}
+	}
+
+	f.advance()
+
+	return acked, lost, nil
+}
+
+// Timeout retransmits fragments which aren't acknowledged in rto since
+// the last transmission, returns number of them
+func (f *SendFlow) Timeout(now time.Time, rto time.Duration) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	lost := make([]*fragment, 0)
+	for e := f.outstanding.Front(); e != nil; e = e.Next() {
+		fr := e.Value.(*fragment)
+		if fr.acked || fr.queued || fr.transmissions == 0 || now.Sub(fr.sentAt) < rto {
+			continue
+		}
+
+		lost = append(lost, fr)
+	}
+
+	timedOut := 0
+	for _, fr := range lost {
+		if f.retransmit(fr) {
+			timedOut++
+		}
+	}
+
+	if f.fsnUpdate && !f.fsnSentAt.IsZero() && now.Sub(f.fsnSentAt) >= rto {
+		f.fsnSentAt = time.Time{} // Forward sequence number is sent again
+	}
+
+	f.advance()
+
+	return timedOut
+}
+
+// abandon marks message abandoned, forward sequence number should be advanced after
+func (f *SendFlow) abandon(msg *message) {
+	msg.abandoned = true
+}
+
+// advance moves forward sequence number over acknowledged and abandoned fragments,
+// the far end is told about it when abandoned fragments are passed
+func (f *SendFlow) advance() {
+	for front := f.outstanding.Front(); front != nil; front = f.outstanding.Front() {
+		fr := front.Value.(*fragment)
+		if !fr.acked && (!fr.msg.abandoned || fr.chunk.Final) {
+			break
+		}
+
+		if !fr.acked {
+			f.fsnUpdate = true
+			f.fsnSentAt = time.Time{}
+		}
+
+		f.outstanding.Remove(front)
+		f.fsn = fr.chunk.SequenceNumber
+	}
+
+	if f.finished() {
+		f.cond.Broadcast()
+	}
+}
+
+func (f *SendFlow) find(seq vlu.Vlu) *fragment {
+	for e := f.outstanding.Front(); e != nil; e = e.Next() {
+		if fr := e.Value.(*fragment); fr.chunk.SequenceNumber == seq {
+			return fr
+		}
+	}
+
+	return nil
+}
+
+func fragmentControl(first bool, last bool) byte {
+	switch {
+	case first && last:
+		return chunks.WholeFragmentControl
+	case first:
+		return chunks.BeginFragmentControl
+	case last:
+		return chunks.EndFragmentControl
+	}
+
+	return chunks.MiddleFragmentControl
+}
@@ -0,0 +1,351 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package flow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rtmfpew/amfy/vlu"
+	"github.com/rtmfpew/rtmfpew/protocol/chunks"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSendFlow(t *testing.T) {
+	Convey("Given a send flow", t, func() {
+		f := NewSendFlow(vlu.Vlu(3), 4)
+
+		Convey("Short message should be sent whole", func() {
+			n, err := f.Write([]byte{0x01, 0x02})
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 2)
+
+			chnk := f.NextChunk()
+			So(chnk, ShouldNotBeNil)
+			So(chnk.FlowID, ShouldEqual, 3)
+			So(chnk.SequenceNumber, ShouldEqual, 1)
+			So(chnk.FsnOffset, ShouldEqual, 1)
+			So(chnk.FragmentControl, ShouldEqual, chunks.WholeFragmentControl)
+			So(chnk.UserData, ShouldResemble, []byte{0x01, 0x02})
+			So(f.NextChunk(), ShouldBeNil)
+		})
+
+		Convey("Long message should be split into fragments", func() {
+			f.Write([]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09})
+			So(f.Pending(), ShouldEqual, 3)
+
+			controls := []byte{}
+			data := []byte{}
+			for chnk := f.NextChunk(); chnk != nil; chnk = f.NextChunk() {
+				controls = append(controls, chnk.FragmentControl)
+				data = append(data, chnk.UserData...)
+			}
+
+			So(controls, ShouldResemble, []byte{
+				chunks.BeginFragmentControl,
+				chunks.MiddleFragmentControl,
+				chunks.EndFragmentControl,
+			})
+			So(data, ShouldResemble, []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09})
+		})
+
+		Convey("Sequence numbers should continue across messages", func() {
+			f.Write([]byte{0x01, 0x02, 0x03, 0x04, 0x05})
+			f.Write([]byte{})
+
+			So(f.NextChunk().SequenceNumber, ShouldEqual, 1)
+			So(f.NextChunk().SequenceNumber, ShouldEqual, 2)
+
+			empty := f.NextChunk()
+			So(empty.SequenceNumber, ShouldEqual, 3)
+			So(empty.FragmentControl, ShouldEqual, chunks.WholeFragmentControl)
+			So(len(empty.UserData), ShouldEqual, 0)
+		})
+
+		Convey("Close should mark the last fragment final", func() {
+			f.Write([]byte{0x01})
+			So(f.Close(), ShouldBeNil)
+			So(f.Close(), ShouldEqual, ErrFlowClosed)
+
+			So(f.NextChunk().Final, ShouldBeTrue)
+
+			_, err := f.Write([]byte{0x02})
+			So(err, ShouldEqual, ErrFlowClosed)
+		})
+
+		Convey("Close of an idle flow should send empty final fragment", func() {
+			f.Write([]byte{0x01})
+			f.NextChunk()
+			f.Close()
+
+			chnk := f.NextChunk()
+			So(chnk.Final, ShouldBeTrue)
+			So(chnk.SequenceNumber, ShouldEqual, 2)
+			So(len(chnk.UserData), ShouldEqual, 0)
+		})
+
+		Convey("Close while the last fragment waits for retransmission should send empty final fragment", func() {
+			f.Write([]byte{0x01})
+			f.NextChunk()
+			So(f.Retransmit(1), ShouldBeTrue)
+			f.Close()
+
+			retransmitted := f.NextChunk()
+			So(retransmitted.SequenceNumber, ShouldEqual, 1)
+			So(retransmitted.Final, ShouldBeFalse)
+
+			chnk := f.NextChunk()
+			So(chnk.Final, ShouldBeTrue)
+			So(chnk.SequenceNumber, ShouldEqual, 2)
+			So(len(chnk.UserData), ShouldEqual, 0)
+		})
+
+		Convey("Smaller fragment size should split fragments which weren't sent yet", func() {
+			f.Write([]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08})
+			f.Close()
+
+			sent := f.NextChunk()
+			f.SetFragmentSize(2)
+			So(f.Pending(), ShouldEqual, 2)
+			So(f.Outstanding(), ShouldEqual, 3)
+
+			seqs := []vlu.Vlu{}
+			controls := []byte{}
+			data := append([]byte{}, sent.UserData...)
+			var last *chunks.UserDataChunk
+			for chnk := f.NextChunk(); chnk != nil; chnk = f.NextChunk() {
+				seqs = append(seqs, chnk.SequenceNumber)
+				controls = append(controls, chnk.FragmentControl)
+				data = append(data, chnk.UserData...)
+				last = chnk
+			}
+
+			So(seqs, ShouldResemble, []vlu.Vlu{2, 3})
+			So(controls, ShouldResemble, []byte{
+				chunks.MiddleFragmentControl,
+				chunks.EndFragmentControl,
+			})
+			So(data, ShouldResemble, []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08})
+			So(last.Final, ShouldBeTrue)
+			So(f.nextSeq, ShouldEqual, 4)
+		})
+	})
+}
+
+func TestSendFlowPartialReliability(t *testing.T) {
+	Convey("Given a send flow", t, func() {
+		f := NewSendFlow(vlu.Vlu(3), 4)
+		now := time.Now()
+
+		Convey("Expired message should be abandoned", func() {
+			f.WriteMessage([]byte{0x01, 0x02, 0x03, 0x04, 0x05}, now.Add(time.Second), UnlimitedRetransmissions)
+			f.Write([]byte{0x06})
+
+			So(f.Abandon(now), ShouldEqual, 0)
+			So(f.Abandon(now.Add(time.Second)), ShouldEqual, 1)
+			So(f.ForwardSequenceNumber(), ShouldEqual, 2)
+			So(f.Outstanding(), ShouldEqual, 1)
+
+			chnk := f.NextChunk()
+			So(chnk.SequenceNumber, ShouldEqual, 3)
+			So(chnk.FsnOffset, ShouldEqual, 1)
+			So(f.NextChunk(), ShouldBeNil)
+		})
+
+		Convey("Flow lifetime should apply to written messages", func() {
+			f.Lifetime = time.Millisecond
+			f.Write([]byte{0x01})
+
+			So(f.Abandon(time.Now().Add(time.Second)), ShouldEqual, 1)
+
+			update := f.NextChunk() // Only forward sequence number is sent
+			So(update.SequenceNumber, ShouldEqual, 1)
+			So(update.Abandon, ShouldBeTrue)
+			So(len(update.UserData), ShouldEqual, 0)
+			So(f.NextChunk(), ShouldBeNil)
+		})
+
+		Convey("Message should be abandoned at retransmissions limit", func() {
+			f.WriteMessage([]byte{0x01}, time.Time{}, 1)
+
+			f.NextChunk()
+			So(f.Retransmit(1), ShouldBeTrue)
+			So(f.Retransmit(1), ShouldBeFalse)
+
+			f.NextChunk()
+			So(f.Retransmit(1), ShouldBeFalse)
+			So(f.ForwardSequenceNumber(), ShouldEqual, 1)
+			So(f.Outstanding(), ShouldEqual, 0)
+		})
+
+		Convey("Unreliable message shouldn't be retransmitted", func() {
+			f.MaxRetransmissions = 0
+			f.Write([]byte{0x01})
+
+			f.NextChunk()
+			So(f.Retransmit(1), ShouldBeFalse)
+			So(f.ForwardSequenceNumber(), ShouldEqual, 1)
+		})
+
+		Convey("Abandoned final fragment should be sent empty with abandon flag", func() {
+			f.WriteMessage([]byte{0x01, 0x02}, now.Add(time.Second), UnlimitedRetransmissions)
+			f.Close()
+
+			f.Abandon(now.Add(time.Second))
+			So(f.ForwardSequenceNumber(), ShouldEqual, 0)
+
+			chnk := f.NextChunk()
+			So(chnk.Final, ShouldBeTrue)
+			So(chnk.Abandon, ShouldBeTrue)
+			So(len(chnk.UserData), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestSendFlowLossDetection(t *testing.T) {
+	Convey("Given a send flow with fragments in flight", t, func() {
+		send := NewSendFlow(vlu.Vlu(7), 16)
+		recv := NewReceiveFlow(vlu.Vlu(7))
+
+		chnks := fragments(send, 6)
+		So(send.Outstanding(), ShouldEqual, 6)
+
+		Convey("Cumulative ack should release fragments", func() {
+			recv.Receive(chnks[0])
+			recv.Receive(chnks[1])
+
+			acked, lost, err := send.HandleAck(recv.Acknowledgement())
+			So(err, ShouldBeNil)
+			So(acked, ShouldEqual, 2)
+			So(lost, ShouldEqual, 0)
+			So(send.ForwardSequenceNumber(), ShouldEqual, 2)
+			So(send.Outstanding(), ShouldEqual, 4)
+		})
+
+		Convey("Fragment should be lost after three later acks", func() {
+			recv.Receive(chnks[0])
+
+			for i := 2; i < 5; i++ {
+				recv.Receive(chnks[i])
+
+				_, lost, err := send.HandleAck(recv.Acknowledgement())
+				So(err, ShouldBeNil)
+
+				if i < 4 {
+					So(lost, ShouldEqual, 0)
+				} else {
+					So(lost, ShouldEqual, 1)
+				}
+			}
+
+			retransmitted := send.NextChunk()
+			So(retransmitted.SequenceNumber, ShouldEqual, 2)
+			So(retransmitted.FsnOffset, ShouldEqual, 1)
+			So(send.NextChunk(), ShouldBeNil)
+
+			recv.Receive(retransmitted)
+			send.HandleAck(recv.Acknowledgement())
+			So(send.ForwardSequenceNumber(), ShouldEqual, 5)
+		})
+
+		Convey("Ranges acknowledgement should be decoded", func() {
+			ack := &chunks.DataAcknowledgementRangesChunk{
+				FlowID:        7,
+				CumulativeAck: 1,
+				Ranges: []chunks.DataAcknowledgementRange{
+					{HolesMinusOne: 1, ReceivedMinusOne: 1}, // 4 and 5
+				},
+			}
+
+			acked, _, err := send.HandleAck(ack)
+			So(err, ShouldBeNil)
+			So(acked, ShouldEqual, 3)
+			So(send.Outstanding(), ShouldEqual, 5)
+		})
+
+		Convey("Ack of another flow should be rejected", func() {
+			_, _, err := send.HandleAck(&chunks.DataAcknowledgementBitmapChunk{FlowID: 8})
+			So(err, ShouldEqual, ErrFlowMismatch)
+		})
+
+		Convey("Fragments should be retransmitted on timeout", func() {
+			now := time.Now()
+			So(send.Timeout(now, time.Second), ShouldEqual, 0)
+			So(send.Timeout(now.Add(time.Second), time.Second), ShouldEqual, 6)
+			So(send.Pending(), ShouldEqual, 6)
+
+			So(send.Timeout(now.Add(2*time.Second), time.Second), ShouldEqual, 0)
+		})
+	})
+}
+
+func TestSendFlowOptions(t *testing.T) {
+	Convey("Given a return flow", t, func() {
+		f := NewSendFlowWithOptions(vlu.Vlu(3), 16, []chunks.UserDataOption{ReturnFlowAssociation(vlu.Vlu(5))})
+
+		Convey("Options should shrink fragments", func() {
+			f.Write(make([]byte, 16))
+
+			chnk := f.NextChunk()
+			So(len(chnk.UserData), ShouldEqual, 12)
+		})
+
+		Convey("Options should be sent until acknowledged", func() {
+			chnks := fragments(f, 2)
+			So(chnks[0].Options, ShouldResemble, f.Options())
+			So(chnks[1].Options, ShouldResemble, f.Options())
+
+			recv := NewReceiveFlow(vlu.Vlu(3))
+			recv.Receive(chnks[1])
+
+			ID, ok := recv.ReturnFlowID()
+			So(ok, ShouldBeTrue)
+			So(ID, ShouldEqual, 5)
+
+			f.HandleAck(recv.Acknowledgement())
+			So(fragments(f, 1)[0].Options, ShouldBeNil)
+		})
+
+		Convey("Metadata should be received with the first fragment", func() {
+			f := NewSendFlowWithOptions(vlu.Vlu(3), 16, []chunks.UserDataOption{
+				PerFlowMetadata([]byte{0x54, 0x43}),
+				ReturnFlowAssociation(vlu.Vlu(5)),
+			})
+			So(f.Metadata(), ShouldResemble, []byte{0x54, 0x43})
+
+			recv := NewReceiveFlow(vlu.Vlu(3))
+			So(recv.Metadata(), ShouldBeNil)
+
+			recv.Receive(fragments(f, 1)[0])
+			So(recv.Metadata(), ShouldResemble, []byte{0x54, 0x43})
+
+			ID, ok := recv.ReturnFlowID()
+			So(ok, ShouldBeTrue)
+			So(ID, ShouldEqual, 5)
+		})
+
+		Convey("Unassociated flow shouldn't have return flow", func() {
+			_, ok := NewSendFlow(vlu.Vlu(3), 16).ReturnFlowID()
+			So(ok, ShouldBeFalse)
+
+			ID, ok := f.ReturnFlowID()
+			So(ok, ShouldBeTrue)
+			So(ID, ShouldEqual, 5)
+		})
+	})
+}
@@ -27,7 +27,7 @@ import (
 
 // Address origins
 const (
-	UnknownOrigin = 0
+	UnknownOrigin = iota
 	LocalOrigin
 	RemoteOrigin
 	ProxyOrigin
@@ -47,9 +47,15 @@ func (addr *PeerAddress) Length() int {
 		2 // port uint16
 }
 
+// PeerAddressFrom creates local PeerAddress from UDP address
 func PeerAddressFrom(udpAddr *net.UDPAddr) *PeerAddress {
+	ip := udpAddr.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
 	addr := &PeerAddress{
-		IP:     []byte(udpAddr.IP),
+		IP:     []byte(ip),
 		Origin: LocalOrigin,
 		Port:   uint16(udpAddr.Port),
 	}
@@ -57,6 +63,14 @@ func PeerAddressFrom(udpAddr *net.UDPAddr) *PeerAddress {
 	return addr
 }
 
+// UDPAddr converts PeerAddress to UDP address
+func (addr *PeerAddress) UDPAddr() *net.UDPAddr {
+	return &net.UDPAddr{
+		IP:   net.IP(addr.IP),
+		Port: int(addr.Port),
+	}
+}
+
 func (addr *PeerAddress) ReadFrom(buffer *bytes.Buffer) (err error) {
 
 	flags, err := buffer.ReadByte()
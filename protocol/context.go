@@ -0,0 +1,321 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rtmfpew/rtmfpew/config"
+	"github.com/rtmfpew/rtmfpew/protocol/session"
+)
+
+// maxDatagramSize is the largest UDP payload we are able to receive
+const maxDatagramSize = 65535
+
+// minPacketSize is a scrambled session ID followed by a single cipher block
+const minPacketSize = 4 + 16
+
+// acceptBacklog is a number of established sessions waiting to be accepted
+const acceptBacklog = 128
+
+// maxStartupReassemblies is a number of far end addresses startup packets are reassembled from at once
+const maxStartupReassemblies = 1024
+
+// ErrClosed is returned by operations on the closed endpoint
+var ErrClosed = errors.New("Endpoint is closed")
+
+// Context is an endpoint runtime. It owns UDP socket, demultiplexes
+// incoming packets to sessions and flushes outgoing ones.
+type Context struct {
+	unknownIDs uint64 // Accessed atomically, kept first to be 64-bit aligned
+
+	Mode Mode
+
+	HandshakeTimeout time.Duration
+
+	// KeepaliveInterval and MaxUnansweredPings are applied to new sessions
+	KeepaliveInterval  time.Duration
+	MaxUnansweredPings int
+
+	// Congestion creates congestion controller for new sessions, default one is used if it's nil
+	Congestion func(mss int) session.CongestionController
+
+	conn *net.UDPConn
+
+	mu         sync.RWMutex
+	sessions   map[uint32]*session.Session
+	initiators map[uint32]*session.Initiator
+	responder  *session.Responder
+	accept     chan *session.Session
+
+	// startup reassembles fragmented startup packets by far end address
+	startup map[string]*session.Session
+
+	closing  chan struct{}
+	shutOnce sync.Once
+	wg       sync.WaitGroup
+	err      error
+}
+
+func newContext(conn *net.UDPConn, mode Mode) *Context {
+	ctx := &Context{
+		Mode:               mode,
+		HandshakeTimeout:   config.HandshakeTimeout(),
+		KeepaliveInterval:  config.KeepaliveInterval(),
+		MaxUnansweredPings: config.MaxUnansweredPings(),
+		conn:               conn,
+		sessions:           make(map[uint32]*session.Session),
+		initiators:         make(map[uint32]*session.Initiator),
+		startup:            make(map[string]*session.Session),
+		accept:             make(chan *session.Session, acceptBacklog),
+		closing:            make(chan struct{}),
+	}
+
+	return ctx
+}
+
+func (ctx *Context) start() {
+	ctx.wg.Add(2)
+	go ctx.receiveLoop()
+	go ctx.sendLoop()
+}
+
+// Addr returns local endpoint address
+func (ctx *Context) Addr() *net.UDPAddr {
+	return ctx.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// AddSession registers session to receive packets addressed to it's ID
+func (ctx *Context) AddSession(s *session.Session) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	ctx.configure(s)
+	ctx.sessions[s.ID] = s
+}
+
+// configure applies endpoint wide settings to the session
+func (ctx *Context) configure(s *session.Session) {
+	s.SetKeepalive(ctx.KeepaliveInterval, ctx.MaxUnansweredPings)
+
+	if ctx.Congestion != nil {
+		s.SetCongestionController(ctx.Congestion(s.MSS()))
+	}
+}
+
+// RemoveSession unregisters session with specified ID
+func (ctx *Context) RemoveSession(ID uint32) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	delete(ctx.sessions, ID)
+}
+
+// removeSession unregisters closed session unless it's already replaced
+func (ctx *Context) removeSession(s *session.Session) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if ctx.sessions[s.ID] == s {
+		delete(ctx.sessions, s.ID)
+	}
+}
+
+// Session returns registered session by ID or nil
+func (ctx *Context) Session(ID uint32) *session.Session {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+
+	return ctx.sessions[ID]
+}
+
+// UnknownIDs returns number of packets dropped for being addressed to unknown session ID
+func (ctx *Context) UnknownIDs() uint64 {
+	return atomic.LoadUint64(&ctx.unknownIDs)
+}
+
+// Accept waits for the next session initiated by a far end
+func (ctx *Context) Accept(goCtx context.Context) (*session.Session, error) {
+	select {
+	case s := <-ctx.accept:
+		return s, nil
+	case <-goCtx.Done():
+		return nil, goCtx.Err()
+	case <-ctx.closing:
+		return nil, ErrClosed
+	}
+}
+
+// Close stops endpoint runtime and releases UDP socket
+func (ctx *Context) Close() error {
+	ctx.shutdown(nil)
+	ctx.wg.Wait()
+
+	return ctx.err
+}
+
+// Wait blocks until endpoint runtime is stopped
+func (ctx *Context) Wait() error {
+	<-ctx.closing
+	ctx.wg.Wait()
+
+	return ctx.err
+}
+
+func (ctx *Context) shutdown(err error) {
+	ctx.shutOnce.Do(func() {
+		ctx.err = err
+		close(ctx.closing)
+
+		if closeErr := ctx.conn.Close(); ctx.err == nil {
+			ctx.err = closeErr
+		}
+	})
+}
+
+func (ctx *Context) isClosing() bool {
+	select {
+	case <-ctx.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+func (ctx *Context) receiveLoop() {
+	defer ctx.wg.Done()
+
+	buff := make([]byte, maxDatagramSize)
+
+	for {
+		n, addr, err := ctx.conn.ReadFromUDP(buff)
+		if err != nil {
+			if ctx.isClosing() {
+				return
+			}
+
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+
+			ctx.shutdown(err)
+			return
+		}
+
+		if n < minPacketSize {
+			continue
+		}
+
+		data := make([]byte, n)
+		copy(data, buff[:n])
+
+		ctx.dispatch(data, addr)
+	}
+}
+
+// dispatch routes packet to the session it's addressed to
+func (ctx *Context) dispatch(data []byte, addr *net.UDPAddr) {
+	ID, err := session.ReadID(data)
+	if err != nil {
+		return
+	}
+
+	s := ctx.Session(ID)
+	if s == nil { // Handshake in progress, far end without a session yet or unknown one
+		ctx.dispatchStartup(ID, data, addr)
+		return
+	}
+
+	pckt, err := s.ReadPacket(bytes.NewBuffer(data))
+	if err != nil {
+		return
+	}
+
+	s.Receive(pckt, addr)
+
+	if pckt.TimeCritical {
+		ctx.timeCriticalObserved(s, true, time.Now())
+	}
+}
+
+// timeCriticalObserved makes the other sessions yield to time critical traffic of the session
+func (ctx *Context) timeCriticalObserved(s *session.Session, received bool, now time.Time) {
+	ctx.mu.RLock()
+	defer ctx.mu.RUnlock()
+
+	for _, other := range ctx.sessions {
+		if other != s {
+			other.TimeCriticalObserved(received, now)
+		}
+	}
+}
+
+func (ctx *Context) sendLoop() {
+	defer ctx.wg.Done()
+
+	ticker := time.NewTicker(config.SchedulerInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.closing:
+			return
+		case now := <-ticker.C:
+			ctx.pollHandshakes(now)
+			ctx.flush()
+		}
+	}
+}
+
+// flush writes out packets of all the sessions
+func (ctx *Context) flush() {
+	ctx.mu.RLock()
+	sessions := make([]*session.Session, 0, len(ctx.sessions))
+	for _, s := range ctx.sessions {
+		sessions = append(sessions, s)
+	}
+	ctx.mu.RUnlock()
+
+	for _, s := range sessions {
+		addr := s.Addr()
+		if addr == nil {
+			continue
+		}
+
+		packets, _ := s.Flush()
+		for _, pckt := range packets {
+			if _, err := ctx.conn.WriteToUDP(pckt.Bytes(), addr); err != nil && ctx.isClosing() {
+				return
+			}
+		}
+
+		if s.Err() != nil { // Session ID is free to be reused
+			ctx.removeSession(s)
+			continue
+		}
+
+		if now := time.Now(); s.SendsTimeCritical(now) {
+			ctx.timeCriticalObserved(s, false, now)
+		}
+	}
+}
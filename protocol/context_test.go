@@ -0,0 +1,265 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package protocol
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rtmfpew/rtmfpew/protocol/chunks"
+	"github.com/rtmfpew/rtmfpew/protocol/session"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestContextRuntime(t *testing.T) {
+	Convey("Given a running endpoint and a peer socket", t, func() {
+		ctx, err := Run("127.0.0.1:0", ServerMode)
+		So(err, ShouldBeNil)
+
+		peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		So(err, ShouldBeNil)
+
+		s := session.New(nil)
+		s.ID = 0x1A2B3C4D
+		s.RemoteID = 0x4D3C2B1A
+		ctx.AddSession(s)
+
+		Convey("Packets should be demultiplexed to the session by ID", func() {
+			remote := session.New(nil)
+			remote.RemoteID = s.ID
+
+			pckt := session.Packet{
+				Mode:   session.InitiatorMode,
+				Chunks: list.New(),
+			}
+			pckt.Chunks.PushBack(chunks.PingChunkSample())
+
+			buff := bytes.NewBuffer(make([]byte, 0))
+			So(remote.WritePacket(pckt, buff), ShouldBeNil)
+
+			_, err := peer.WriteToUDP(buff.Bytes(), ctx.Addr())
+			So(err, ShouldBeNil)
+
+			deadline := time.Now().Add(time.Second)
+			for s.Addr() == nil && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+
+			So(s.Addr(), ShouldNotBeNil)
+			So(s.Addr().Port, ShouldEqual, peer.LocalAddr().(*net.UDPAddr).Port)
+		})
+
+		Convey("Packets addressed to unknown session ID should be dropped and counted", func() {
+			remote := session.New(nil)
+			remote.RemoteID = s.ID + 1
+
+			pckt := session.Packet{
+				Mode:   session.InitiatorMode,
+				Chunks: list.New(),
+			}
+			pckt.Chunks.PushBack(chunks.PingChunkSample())
+
+			buff := bytes.NewBuffer(make([]byte, 0))
+			So(remote.WritePacket(pckt, buff), ShouldBeNil)
+
+			_, err := peer.WriteToUDP(buff.Bytes(), ctx.Addr())
+			So(err, ShouldBeNil)
+
+			deadline := time.Now().Add(time.Second)
+			for ctx.UnknownIDs() == 0 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+
+			So(ctx.UnknownIDs(), ShouldEqual, 1)
+			So(s.Addr(), ShouldBeNil)
+		})
+
+		Convey("New session IDs should be unique and non-zero", func() {
+			ctx.mu.Lock()
+			defer ctx.mu.Unlock()
+
+			unique := true
+			for i := 0; i < 1000; i++ {
+				ID, err := ctx.newSessionID()
+				if err != nil || ID == 0 || ctx.sessions[ID] != nil {
+					unique = false
+				}
+
+				ctx.sessions[ID] = s
+			}
+
+			So(unique, ShouldBeTrue)
+		})
+
+		Convey("Queued chunks should be flushed to the session address", func() {
+			s.SetAddr(peer.LocalAddr().(*net.UDPAddr))
+			s.Send(chunks.PingChunkSample())
+
+			peer.SetReadDeadline(time.Now().Add(time.Second))
+			data := make([]byte, 1500)
+			n, _, err := peer.ReadFromUDP(data)
+			So(err, ShouldBeNil)
+
+			ID, err := session.ReadID(data[:n])
+			So(err, ShouldBeNil)
+			So(ID, ShouldEqual, s.RemoteID)
+		})
+
+		Convey("Close should stop the runtime", func() {
+			So(ctx.Close(), ShouldBeNil)
+			So(ctx.Wait(), ShouldBeNil)
+		})
+
+		Reset(func() {
+			peer.Close()
+			ctx.Close()
+		})
+	})
+}
+
+func TestContextConnect(t *testing.T) {
+	Convey("Given a client endpoint and a silent responder socket", t, func() {
+		ctx, err := Run("127.0.0.1:0", ClientMode)
+		So(err, ShouldBeNil)
+
+		responder, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		So(err, ShouldBeNil)
+		addr := responder.LocalAddr().(*net.UDPAddr)
+
+		Convey("Connect should time out with handshake error", func() {
+			ctx.HandshakeTimeout = 50 * time.Millisecond
+
+			s, err := ctx.Connect(context.Background(), addr, []byte("rtmfp://localhost/app"))
+			So(s, ShouldBeNil)
+
+			_, ok := err.(*session.HandshakeTimeoutError)
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("Connect should respect context cancellation", func() {
+			goCtx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+
+			s, err := ctx.Connect(goCtx, addr, []byte("rtmfp://localhost/app"))
+			So(s, ShouldBeNil)
+			So(err, ShouldEqual, context.DeadlineExceeded)
+		})
+
+		Reset(func() {
+			responder.Close()
+			ctx.Close()
+		})
+	})
+}
+
+func TestContextHandshake(t *testing.T) {
+	Convey("Given a server and a client endpoint", t, func() {
+		server, err := Run("127.0.0.1:0", ServerMode)
+		So(err, ShouldBeNil)
+
+		client, err := Run("127.0.0.1:0", ClientMode)
+		So(err, ShouldBeNil)
+
+		Convey("Connect should complete the four-way handshake", func() {
+			goCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			s, err := client.Connect(goCtx, server.Addr(), []byte("rtmfp://localhost/app"))
+			So(err, ShouldBeNil)
+			So(client.Session(s.ID), ShouldEqual, s)
+
+			accepted, err := server.Accept(goCtx)
+			So(err, ShouldBeNil)
+			So(accepted.RemoteID, ShouldEqual, s.ID)
+			So(accepted.ID, ShouldEqual, s.RemoteID)
+			So(server.Session(accepted.ID), ShouldEqual, accepted)
+		})
+
+		Convey("Handshake packets larger than mtu should be fragmented", func() {
+			goCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			epd := append([]byte("rtmfp://localhost/"), bytes.Repeat([]byte("a"), 2000)...)
+
+			s, err := client.Connect(goCtx, server.Addr(), epd)
+			So(err, ShouldBeNil)
+
+			accepted, err := server.Accept(goCtx)
+			So(err, ShouldBeNil)
+			So(accepted.ID, ShouldEqual, s.RemoteID)
+		})
+
+		Convey("Established sessions should exchange encrypted packets", func() {
+			goCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			s, err := client.Connect(goCtx, server.Addr(), []byte("rtmfp://localhost/app"))
+			So(err, ShouldBeNil)
+
+			accepted, err := server.Accept(goCtx)
+			So(err, ShouldBeNil)
+
+			before := accepted.LastReceived()
+			s.Send(&chunks.PingChunk{Message: []byte("a ping message longer than a single cipher block")})
+
+			deadline := time.Now().Add(time.Second)
+			for accepted.LastReceived() == before && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+
+			So(accepted.LastReceived(), ShouldHappenAfter, before)
+		})
+
+		Convey("Closed sessions should free their IDs at both ends", func() {
+			goCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			s, err := client.Connect(goCtx, server.Addr(), []byte("rtmfp://localhost/app"))
+			So(err, ShouldBeNil)
+
+			accepted, err := server.Accept(goCtx)
+			So(err, ShouldBeNil)
+
+			So(s.Close(), ShouldBeNil)
+
+			select {
+			case <-s.Done():
+			case <-goCtx.Done():
+			}
+
+			So(s.Err(), ShouldEqual, session.ErrSessionClosed)
+			So(accepted.Closing(), ShouldBeTrue)
+
+			deadline := time.Now().Add(time.Second)
+			for client.Session(s.ID) != nil && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+
+			So(client.Session(s.ID), ShouldBeNil)
+		})
+
+		Reset(func() {
+			client.Close()
+			server.Close()
+		})
+	})
+}
@@ -15,3 +15,258 @@
 //
 
 package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+
+	"github.com/rtmfpew/amfy/vlu"
+)
+
+// Certificate option types
+const (
+	AcceptsAncillaryDataOptionType      = 0x0a
+	SupportedEphemeralDHGroupOptionType = 0x0d
+	ExtraRandomnessOptionType           = 0x0e
+	StaticDHPublicKeyOptionType         = 0x1d
+)
+
+// Endpoint discriminator option types
+const (
+	AncillaryDataOptionType = 0x0a
+	FingerprintOptionType   = 0x0f
+)
+
+// extraRandomnessLength makes every ephemeral certificate unique
+const extraRandomnessLength = 32
+
+// PeerIDLength is a length of SHA-256 peer ID
+const PeerIDLength = sha256.Size
+
+// PeerID identifies endpoint by SHA-256 of its certificate
+type PeerID [PeerIDLength]byte
+
+func (ID PeerID) String() string {
+	return hex.EncodeToString(ID[:])
+}
+
+// Certificate is Flash profile certificate, an options list
+type Certificate struct {
+	AcceptsAncillaryData bool
+	EphemeralDHGroups    []vlu.Vlu
+	ExtraRandomness      []byte
+
+	StaticDHGroup     vlu.Vlu
+	StaticDHPublicKey []byte
+
+	raw []byte
+}
+
+// NewCertificate creates ephemeral certificate with extra randomness
+func NewCertificate() (*Certificate, error) {
+	randomness := make([]byte, extraRandomnessLength)
+	if _, err := rand.Read(randomness); err != nil {
+		return nil, err
+	}
+
+	cert := &Certificate{
+		AcceptsAncillaryData: true,
+		EphemeralDHGroups:    []vlu.Vlu{DHGroup1024},
+		ExtraRandomness:      randomness,
+	}
+
+	return cert, nil
+}
+
+// ParseCertificate reads certificate options, unknown options are ignored
+func ParseCertificate(data []byte) (*Certificate, error) {
+	opts, err := ReadOptions(data)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &Certificate{
+		raw: data,
+	}
+
+	for i := range opts {
+		switch opts[i].Type {
+		case AcceptsAncillaryDataOptionType:
+			cert.AcceptsAncillaryData = true
+
+		case SupportedEphemeralDHGroupOptionType:
+			group := vlu.Vlu(0)
+			if err = group.ReadFrom(bytes.NewBuffer(opts[i].Value)); err != nil {
+				return nil, err
+			}
+
+			cert.EphemeralDHGroups = append(cert.EphemeralDHGroups, group)
+
+		case ExtraRandomnessOptionType:
+			cert.ExtraRandomness = opts[i].Value
+
+		case StaticDHPublicKeyOptionType:
+			buff := bytes.NewBuffer(opts[i].Value)
+			if err = cert.StaticDHGroup.ReadFrom(buff); err != nil {
+				return nil, err
+			}
+
+			cert.StaticDHPublicKey = buff.Bytes()
+		}
+	}
+
+	return cert, nil
+}
+
+// IsStatic returns true if certificate carries static DH public key
+func (cert *Certificate) IsStatic() bool {
+	return len(cert.StaticDHPublicKey) > 0
+}
+
+// SupportsEphemeralDHGroup checks if far end accepts ephemeral keys of the group
+func (cert *Certificate) SupportsEphemeralDHGroup(group vlu.Vlu) bool {
+	for _, g := range cert.EphemeralDHGroups {
+		if g == group {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Bytes returns certificate as it was parsed, or encodes it in options order
+func (cert *Certificate) Bytes() ([]byte, error) {
+	if cert.raw != nil {
+		return cert.raw, nil
+	}
+
+	opts := make([]Option, 0, 3+len(cert.EphemeralDHGroups))
+
+	if cert.AcceptsAncillaryData {
+		opts = append(opts, Option{Type: AcceptsAncillaryDataOptionType})
+	}
+
+	for _, group := range cert.EphemeralDHGroups {
+		value := bytes.NewBuffer(nil)
+		if err := group.WriteTo(value); err != nil {
+			return nil, err
+		}
+
+		opts = append(opts, Option{Type: SupportedEphemeralDHGroupOptionType, Value: value.Bytes()})
+	}
+
+	if len(cert.ExtraRandomness) > 0 {
+		opts = append(opts, Option{Type: ExtraRandomnessOptionType, Value: cert.ExtraRandomness})
+	}
+
+	if cert.IsStatic() {
+		value := bytes.NewBuffer(nil)
+		if err := cert.StaticDHGroup.WriteTo(value); err != nil {
+			return nil, err
+		}
+
+		value.Write(cert.StaticDHPublicKey)
+		opts = append(opts, Option{Type: StaticDHPublicKeyOptionType, Value: value.Bytes()})
+	}
+
+	buff := bytes.NewBuffer(nil)
+	if err := WriteOptions(buff, opts); err != nil {
+		return nil, err
+	}
+
+	cert.raw = buff.Bytes()
+
+	return cert.raw, nil
+}
+
+// PeerID computes SHA-256 of the certificate
+func (cert *Certificate) PeerID() (PeerID, error) {
+	data, err := cert.Bytes()
+	if err != nil {
+		return PeerID{}, err
+	}
+
+	return sha256.Sum256(data), nil
+}
+
+// Epd is Flash profile endpoint discriminator selecting
+// the far end either by ancillary data or by peer ID
+type Epd struct {
+	AncillaryData []byte
+	Fingerprint   []byte
+}
+
+// AncillaryDataEpd creates discriminator for server endpoints, usually with URL
+func AncillaryDataEpd(data []byte) *Epd {
+	return &Epd{AncillaryData: data}
+}
+
+// FingerprintEpd creates discriminator for the peer with ID
+func FingerprintEpd(ID PeerID) *Epd {
+	return &Epd{Fingerprint: ID[:]}
+}
+
+// ParseEpd reads endpoint discriminator options
+func ParseEpd(data []byte) (*Epd, error) {
+	opts, err := ReadOptions(data)
+	if err != nil {
+		return nil, err
+	}
+
+	epd := &Epd{}
+
+	if opt := FindOption(opts, AncillaryDataOptionType); opt != nil {
+		epd.AncillaryData = opt.Value
+	}
+
+	if opt := FindOption(opts, FingerprintOptionType); opt != nil {
+		if len(opt.Value) != PeerIDLength {
+			return nil, errors.New("Invalid fingerprint length")
+		}
+
+		epd.Fingerprint = opt.Value
+	}
+
+	if epd.AncillaryData == nil && epd.Fingerprint == nil {
+		return nil, errors.New("Endpoint discriminator is empty")
+	}
+
+	return epd, nil
+}
+
+// Bytes encodes endpoint discriminator
+func (epd *Epd) Bytes() ([]byte, error) {
+	opts := make([]Option, 0, 2)
+
+	if epd.AncillaryData != nil {
+		opts = append(opts, Option{Type: AncillaryDataOptionType, Value: epd.AncillaryData})
+	}
+
+	if epd.Fingerprint != nil {
+		opts = append(opts, Option{Type: FingerprintOptionType, Value: epd.Fingerprint})
+	}
+
+	buff := bytes.NewBuffer(nil)
+	if err := WriteOptions(buff, opts); err != nil {
+		return nil, err
+	}
+
+	return buff.Bytes(), nil
+}
+
+// Selects checks if endpoint discriminator selects the owner of the certificate
+func (epd *Epd) Selects(cert *Certificate) bool {
+	if epd.Fingerprint != nil {
+		ID, err := cert.PeerID()
+		if err != nil {
+			return false
+		}
+
+		return bytes.Equal(epd.Fingerprint, ID[:])
+	}
+
+	return cert.AcceptsAncillaryData
+}
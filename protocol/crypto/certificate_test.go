@@ -0,0 +1,125 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package crypto
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/rtmfpew/amfy/vlu"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCertificate(t *testing.T) {
+	Convey("Given an ephemeral certificate", t, func() {
+		cert, err := NewCertificate()
+		So(err, ShouldBeNil)
+
+		data, err := cert.Bytes()
+		So(err, ShouldBeNil)
+
+		Convey("It should be parsed back", func() {
+			parsed, err := ParseCertificate(data)
+			So(err, ShouldBeNil)
+			So(parsed.AcceptsAncillaryData, ShouldBeTrue)
+			So(parsed.SupportsEphemeralDHGroup(DHGroup1024), ShouldBeTrue)
+			So(parsed.ExtraRandomness, ShouldResemble, cert.ExtraRandomness)
+			So(parsed.IsStatic(), ShouldBeFalse)
+		})
+
+		Convey("Peer ID should be SHA-256 of the certificate", func() {
+			ID, err := cert.PeerID()
+			So(err, ShouldBeNil)
+			So(ID, ShouldEqual, PeerID(sha256.Sum256(data)))
+			So(len(ID.String()), ShouldEqual, 2*PeerIDLength)
+
+			parsed, _ := ParseCertificate(data)
+			parsedID, _ := parsed.PeerID()
+			So(parsedID, ShouldEqual, ID)
+
+			other, _ := NewCertificate()
+			otherID, _ := other.PeerID()
+			So(otherID, ShouldNotEqual, ID)
+		})
+
+		Convey("Static key should be kept", func() {
+			dh, _ := NewDiffieHellman()
+			static := &Certificate{
+				StaticDHGroup:     vlu.Vlu(DHGroup1024),
+				StaticDHPublicKey: dh.PublicKey(),
+			}
+
+			data, err := static.Bytes()
+			So(err, ShouldBeNil)
+
+			parsed, err := ParseCertificate(data)
+			So(err, ShouldBeNil)
+			So(parsed.IsStatic(), ShouldBeTrue)
+			So(parsed.StaticDHGroup, ShouldEqual, DHGroup1024)
+			So(parsed.StaticDHPublicKey, ShouldResemble, dh.PublicKey())
+			So(parsed.AcceptsAncillaryData, ShouldBeFalse)
+		})
+
+		Convey("Truncated certificate should be rejected", func() {
+			_, err := ParseCertificate(data[:len(data)-1])
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestEpd(t *testing.T) {
+	Convey("Given a certificate", t, func() {
+		cert, _ := NewCertificate()
+		ID, _ := cert.PeerID()
+
+		Convey("Ancillary data discriminator should be encoded as option 0x0a", func() {
+			data, err := AncillaryDataEpd([]byte("rtmfp://localhost/app")).Bytes()
+			So(err, ShouldBeNil)
+			So(data[1], ShouldEqual, AncillaryDataOptionType)
+
+			epd, err := ParseEpd(data)
+			So(err, ShouldBeNil)
+			So(epd.AncillaryData, ShouldResemble, []byte("rtmfp://localhost/app"))
+			So(epd.Fingerprint, ShouldBeNil)
+			So(epd.Selects(cert), ShouldBeTrue)
+		})
+
+		Convey("Fingerprint discriminator should select peer by ID", func() {
+			data, err := FingerprintEpd(ID).Bytes()
+			So(err, ShouldBeNil)
+			So(data, ShouldResemble, append([]byte{1 + PeerIDLength, FingerprintOptionType}, ID[:]...))
+
+			epd, err := ParseEpd(data)
+			So(err, ShouldBeNil)
+			So(bytes.Equal(epd.Fingerprint, ID[:]), ShouldBeTrue)
+			So(epd.Selects(cert), ShouldBeTrue)
+
+			other, _ := NewCertificate()
+			So(epd.Selects(other), ShouldBeFalse)
+		})
+
+		Convey("Malformed discriminators should be rejected", func() {
+			_, err := ParseEpd([]byte{})
+			So(err, ShouldNotBeNil)
+
+			_, err = ParseEpd([]byte{0x03, FingerprintOptionType, 0x01, 0x02})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
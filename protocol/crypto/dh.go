@@ -0,0 +1,94 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package crypto
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+)
+
+// DH group IDs
+const (
+	DHGroup1024 = 2 // 1024-bit MODP group from RFC 2409
+)
+
+// dhKeyLength is a byte length of 1024-bit MODP group keys
+const dhKeyLength = 128
+
+var dhPrime, _ = new(big.Int).SetString(
+	"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1"+
+		"29024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+		"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245"+
+		"E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED"+
+		"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE65381"+
+		"FFFFFFFFFFFFFFFF", 16)
+
+var dhGenerator = big.NewInt(2)
+
+// DiffieHellman is an ephemeral key pair of 1024-bit MODP group
+type DiffieHellman struct {
+	private *big.Int
+	public  *big.Int
+}
+
+// NewDiffieHellman generates ephemeral key pair
+func NewDiffieHellman() (*DiffieHellman, error) {
+	private, err := rand.Int(rand.Reader, dhPrime)
+	if err != nil {
+		return nil, err
+	}
+
+	if private.Cmp(big.NewInt(2)) < 0 {
+		private.SetInt64(2)
+	}
+
+	dh := &DiffieHellman{
+		private: private,
+		public:  new(big.Int).Exp(dhGenerator, private, dhPrime),
+	}
+
+	return dh, nil
+}
+
+// PublicKey returns big-endian public key padded to the group size
+func (dh *DiffieHellman) PublicKey() []byte {
+	return padKey(dh.public.Bytes())
+}
+
+// SharedSecret computes secret shared with the owner of the far end public key
+func (dh *DiffieHellman) SharedSecret(farPublicKey []byte) ([]byte, error) {
+	public := new(big.Int).SetBytes(farPublicKey)
+
+	max := new(big.Int).Sub(dhPrime, big.NewInt(1))
+	if public.Cmp(big.NewInt(1)) <= 0 || public.Cmp(max) >= 0 {
+		return nil, errors.New("Invalid Diffie-Hellman public key")
+	}
+
+	return padKey(new(big.Int).Exp(public, dh.private, dhPrime).Bytes()), nil
+}
+
+func padKey(key []byte) []byte {
+	if len(key) >= dhKeyLength {
+		return key
+	}
+
+	padded := make([]byte, dhKeyLength)
+	copy(padded[dhKeyLength-len(key):], key)
+
+	return padded
+}
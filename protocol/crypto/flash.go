@@ -0,0 +1,243 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"github.com/rtmfpew/amfy/vlu"
+	"github.com/rtmfpew/rtmfpew/protocol/ip"
+)
+
+// Session key component option types
+const (
+	EphemeralDHPublicKeyOptionType = 0x0d
+)
+
+// FlashProfile is RFC 7425 crypto profile of Flash Player and AIR.
+// Session keys are negotiated with Diffie-Hellman key agreement,
+// packets are encrypted with AES-128-CBC and zero IV.
+type FlashProfile struct {
+	dh *DiffieHellman
+
+	initiatorNonce []byte
+	responderNonce []byte
+
+	encryptCipher cipher.Block
+	decryptCipher cipher.Block
+}
+
+// NewFlashProfile creates profile with default key and ephemeral DH key pair
+func NewFlashProfile() (*FlashProfile, error) {
+	dh, err := NewDiffieHellman()
+	if err != nil {
+		return nil, err
+	}
+
+	profile := &FlashProfile{dh: dh}
+	if err = profile.InitDefault(); err != nil {
+		return nil, err
+	}
+
+	return profile, nil
+}
+
+// Init crypto profile with the same key for both directions
+func (profile *FlashProfile) Init(key []byte) error {
+	return profile.InitKeys(key, key)
+}
+
+// InitDefault init crypto profile with default encryption key
+func (profile *FlashProfile) InitDefault() error {
+	return profile.Init(DefaultKey[:16])
+}
+
+// InitKeys init crypto profile with separate encryption and decryption keys
+func (profile *FlashProfile) InitKeys(encryptKey []byte, decryptKey []byte) error {
+	if len(encryptKey) == 0 || len(decryptKey) == 0 {
+		return errors.New("Encryption key required")
+	}
+
+	encryptCipher, err := aes.NewCipher(encryptKey)
+	if err != nil {
+		return err
+	}
+
+	decryptCipher, err := aes.NewCipher(decryptKey)
+	if err != nil {
+		return err
+	}
+
+	profile.encryptCipher = encryptCipher
+	profile.decryptCipher = decryptCipher
+
+	return nil
+}
+
+// Checksum calculates 16-bit ones' complement checksum
+func (profile *FlashProfile) Checksum(b []byte) []byte {
+	sum := make([]byte, 2)
+	binary.BigEndian.PutUint16(sum, ip.Checksum(b))
+
+	return sum
+}
+
+// ChecksumLen returns checksum length
+func (profile *FlashProfile) ChecksumLen() int {
+	return 2
+}
+
+// EncryptAt encrypts buffer with AES-CBC and zero IV starting at offset
+func (profile *FlashProfile) EncryptAt(data *bytes.Buffer, offset int) error {
+	if profile.encryptCipher == nil {
+		return errors.New("Init crypto profile first")
+	}
+
+	return encryptCBC(profile.encryptCipher, data, offset)
+}
+
+// DecryptAt decrypts buffer with AES-CBC and zero IV starting at offset
+func (profile *FlashProfile) DecryptAt(data *bytes.Buffer, offset int) error {
+	if profile.decryptCipher == nil {
+		return errors.New("Init crypto profile first")
+	}
+
+	return decryptCBC(profile.decryptCipher, data, offset)
+}
+
+// InitiatorComponent returns session key initiator component with DH public key
+func (profile *FlashProfile) InitiatorComponent() ([]byte, error) {
+	component, err := profile.component()
+	if err != nil {
+		return nil, err
+	}
+
+	profile.initiatorNonce = component
+
+	return component, nil
+}
+
+// ResponderComponent computes session keys out of initiator component
+// and returns session key responder component
+func (profile *FlashProfile) ResponderComponent(initiatorComponent []byte) ([]byte, error) {
+	secret, err := profile.sharedSecret(initiatorComponent)
+	if err != nil {
+		return nil, err
+	}
+
+	component, err := profile.component()
+	if err != nil {
+		return nil, err
+	}
+
+	profile.initiatorNonce = initiatorComponent
+	profile.responderNonce = component
+
+	encryptKey := deriveKey(secret, profile.initiatorNonce, profile.responderNonce)
+	decryptKey := deriveKey(secret, profile.responderNonce, profile.initiatorNonce)
+
+	if err = profile.InitKeys(encryptKey, decryptKey); err != nil {
+		return nil, err
+	}
+
+	return component, nil
+}
+
+// FinishKeying computes session keys out of responder component
+func (profile *FlashProfile) FinishKeying(responderComponent []byte) error {
+	if profile.initiatorNonce == nil {
+		return errors.New("Initiator component wasn't sent")
+	}
+
+	secret, err := profile.sharedSecret(responderComponent)
+	if err != nil {
+		return err
+	}
+
+	profile.responderNonce = responderComponent
+
+	encryptKey := deriveKey(secret, profile.responderNonce, profile.initiatorNonce)
+	decryptKey := deriveKey(secret, profile.initiatorNonce, profile.responderNonce)
+
+	return profile.InitKeys(encryptKey, decryptKey)
+}
+
+func (profile *FlashProfile) component() ([]byte, error) {
+	group := vlu.Vlu(DHGroup1024)
+
+	value := bytes.NewBuffer(make([]byte, 0, 1+dhKeyLength))
+	if err := group.WriteTo(value); err != nil {
+		return nil, err
+	}
+
+	value.Write(profile.dh.PublicKey())
+
+	buff := bytes.NewBuffer(make([]byte, 0, 4+value.Len()))
+	opts := []Option{{
+		Type:  EphemeralDHPublicKeyOptionType,
+		Value: value.Bytes(),
+	}}
+
+	if err := WriteOptions(buff, opts); err != nil {
+		return nil, err
+	}
+
+	return buff.Bytes(), nil
+}
+
+func (profile *FlashProfile) sharedSecret(component []byte) ([]byte, error) {
+	opts, err := ReadOptions(component)
+	if err != nil {
+		return nil, err
+	}
+
+	opt := FindOption(opts, EphemeralDHPublicKeyOptionType)
+	if opt == nil {
+		return nil, errors.New("Session key component has no DH public key")
+	}
+
+	value := bytes.NewBuffer(opt.Value)
+
+	group := vlu.Vlu(0)
+	if err = group.ReadFrom(value); err != nil {
+		return nil, err
+	}
+
+	if group != DHGroup1024 {
+		return nil, errors.New("Unsupported DH group")
+	}
+
+	return profile.dh.SharedSecret(value.Bytes())
+}
+
+// deriveKey computes HMAC-SHA256(secret, HMAC-SHA256(key, data)) truncated to 128 bits
+func deriveKey(secret []byte, key []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	digest := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, secret)
+	mac.Write(digest)
+
+	return mac.Sum(nil)[:16]
+}
@@ -0,0 +1,115 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package crypto
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFlashProfileChecksum(t *testing.T) {
+	Convey("Given a Flash profile", t, func() {
+		profile := &FlashProfile{}
+
+		Convey("Checksum should match RFC 1071 example", func() {
+			data := []byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}
+			So(profile.Checksum(data), ShouldResemble, []byte{0x22, 0x0d})
+			So(profile.ChecksumLen(), ShouldEqual, 2)
+		})
+	})
+}
+
+func TestFlashProfile(t *testing.T) {
+	Convey("Given initiator and responder profiles", t, func() {
+		initiator, err := NewFlashProfile()
+		So(err, ShouldBeNil)
+
+		responder, err := NewFlashProfile()
+		So(err, ShouldBeNil)
+
+		Convey("Session key components should carry DH public key", func() {
+			skic, err := initiator.InitiatorComponent()
+			So(err, ShouldBeNil)
+
+			opts, err := ReadOptions(skic)
+			So(err, ShouldBeNil)
+
+			opt := FindOption(opts, EphemeralDHPublicKeyOptionType)
+			So(opt, ShouldNotBeNil)
+			So(opt.Value[0], ShouldEqual, DHGroup1024)
+			So(opt.Value[1:], ShouldResemble, initiator.dh.PublicKey())
+		})
+
+		Convey("Key agreement should derive mirrored keys", func() {
+			skic, err := initiator.InitiatorComponent()
+			So(err, ShouldBeNil)
+
+			skrc, err := responder.ResponderComponent(skic)
+			So(err, ShouldBeNil)
+
+			So(initiator.FinishKeying(skrc), ShouldBeNil)
+
+			plain := []byte("0123456789abcdef0123456789abcdef")
+
+			buff := bytes.NewBuffer(append([]byte{0xAA, 0xBB, 0xCC, 0xDD}, plain...))
+			So(initiator.EncryptAt(buff, 4), ShouldBeNil)
+			So(buff.Bytes()[4:], ShouldNotResemble, plain)
+			So(buff.Bytes()[4:20], ShouldNotResemble, buff.Bytes()[20:])
+
+			So(responder.DecryptAt(buff, 4), ShouldBeNil)
+			So(buff.Bytes()[4:], ShouldResemble, plain)
+
+			buff = bytes.NewBuffer(append([]byte{}, plain...))
+			So(responder.EncryptAt(buff, 0), ShouldBeNil)
+			So(initiator.DecryptAt(buff, 0), ShouldBeNil)
+			So(buff.Bytes(), ShouldResemble, plain)
+		})
+
+		Convey("Directions should use different keys", func() {
+			skic, _ := initiator.InitiatorComponent()
+			skrc, _ := responder.ResponderComponent(skic)
+			initiator.FinishKeying(skrc)
+
+			plain := []byte("0123456789abcdef")
+
+			buff := bytes.NewBuffer(append([]byte{}, plain...))
+			initiator.EncryptAt(buff, 0)
+			initiator.DecryptAt(buff, 0)
+			So(buff.Bytes(), ShouldNotResemble, plain)
+		})
+
+		Convey("Malformed components should be rejected", func() {
+			_, err := responder.ResponderComponent([]byte{0x01})
+			So(err, ShouldNotBeNil)
+
+			So(initiator.FinishKeying([]byte{0x01, 0x02}), ShouldNotBeNil)
+
+			bogus := bytes.NewBuffer(nil)
+			WriteOptions(bogus, []Option{{Type: EphemeralDHPublicKeyOptionType, Value: []byte{DHGroup1024, 0x01}}})
+
+			_, err = responder.ResponderComponent(bogus.Bytes())
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Unaligned body should be rejected", func() {
+			So(initiator.EncryptAt(bytes.NewBuffer(make([]byte, 17)), 0), ShouldNotBeNil)
+			So(initiator.DecryptAt(bytes.NewBuffer(make([]byte, 17)), 0), ShouldNotBeNil)
+		})
+	})
+}
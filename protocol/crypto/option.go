@@ -0,0 +1,94 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package crypto
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/rtmfpew/amfy/vlu"
+)
+
+// Option is a typed value in certificates and session key components
+type Option struct {
+	Type  vlu.Vlu
+	Value []byte
+}
+
+// ReadOptions parses options list until the end of data
+func ReadOptions(data []byte) ([]Option, error) {
+	buff := bytes.NewBuffer(data)
+	opts := make([]Option, 0)
+
+	for buff.Len() > 0 {
+		length := vlu.Vlu(0)
+		if err := length.ReadFrom(buff); err != nil {
+			return nil, err
+		}
+
+		if length == 0 { // Marker, skipped
+			continue
+		}
+
+		if int(length) > buff.Len() {
+			return nil, errors.New("Option is longer than options list")
+		}
+
+		optBuff := bytes.NewBuffer(buff.Next(int(length)))
+
+		opt := Option{}
+		if err := opt.Type.ReadFrom(optBuff); err != nil {
+			return nil, err
+		}
+
+		opt.Value = optBuff.Bytes()
+		opts = append(opts, opt)
+	}
+
+	return opts, nil
+}
+
+// WriteOptions writes options list
+func WriteOptions(buff *bytes.Buffer, opts []Option) error {
+	for i := range opts {
+		length := vlu.Vlu(opts[i].Type.ByteLength() + len(opts[i].Value))
+		if err := length.WriteTo(buff); err != nil {
+			return err
+		}
+
+		if err := opts[i].Type.WriteTo(buff); err != nil {
+			return err
+		}
+
+		if _, err := buff.Write(opts[i].Value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FindOption returns the first option of the type or nil
+func FindOption(opts []Option, typ vlu.Vlu) *Option {
+	for i := range opts {
+		if opts[i].Type == typ {
+			return &opts[i]
+		}
+	}
+
+	return nil
+}
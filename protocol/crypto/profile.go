@@ -22,8 +22,13 @@ import (
 	"crypto/cipher"
 	"crypto/sha256"
 	"errors"
+	"fmt"
 )
 
+// BlockSize is a cipher block size, encrypted part of every packet
+// is padded to be a multiple of it
+const BlockSize = aes.BlockSize
+
 // Profile rtmfp encryption profile interface
 type Profile interface {
 	Init(key []byte) error
@@ -34,6 +39,14 @@ type Profile interface {
 	ChecksumLen() int
 }
 
+// KeyAgreement is a profile negotiating session keys during handshake
+type KeyAgreement interface {
+	Profile
+	InitiatorComponent() ([]byte, error)
+	ResponderComponent(initiatorComponent []byte) ([]byte, error)
+	FinishKeying(responderComponent []byte) error
+}
+
 // DefaultProfile for rmtmfp encryption
 type DefaultProfile struct {
 	key         []byte
@@ -83,30 +96,69 @@ func (profile *DefaultProfile) ChecksumLen() int {
 	return 256
 }
 
-// EncryptAt encrupts buffer with specified block cipher
+// EncryptAt encrypts buffer in CBC mode starting at offset
 func (profile *DefaultProfile) EncryptAt(data *bytes.Buffer, offset int) error {
 	if profile.blockCipher != nil {
-		encryptedBuf := make([]byte, len(data.Bytes())-offset)
-
-		profile.blockCipher.Encrypt(encryptedBuf, data.Bytes()[offset:])
-		copy(data.Bytes()[offset:], encryptedBuf)
-
-		return nil
+		return encryptCBC(profile.blockCipher, data, offset)
 	}
 
 	return errors.New("Init crypto profile first")
 }
 
-// DecryptAt decrypts buffer with specified block cipher starting at offset
+// DecryptAt decrypts buffer in CBC mode starting at offset
 func (profile *DefaultProfile) DecryptAt(data *bytes.Buffer, offset int) error {
 	if profile.blockCipher != nil {
-		decryptedBuff := make([]byte, len(data.Bytes())-offset)
+		return decryptCBC(profile.blockCipher, data, offset)
+	}
 
-		profile.blockCipher.Decrypt(decryptedBuff, data.Bytes()[offset:])
-		copy(data.Bytes()[offset:], decryptedBuff)
+	return errors.New("Init crypto profile first")
+}
 
-		return nil
+// BlockSizeError is returned when encrypted part of a packet
+// isn't a multiple of the cipher block size
+type BlockSizeError struct {
+	Length int
+}
+
+func (err *BlockSizeError) Error() string {
+	return fmt.Sprintf("Packet body of %d bytes isn't a multiple of %d bytes cipher block", err.Length, BlockSize)
+}
+
+// encryptCBC encrypts data in place with zero IV, no padding is added
+func encryptCBC(block cipher.Block, data *bytes.Buffer, offset int) error {
+	body, err := cbcBody(data, offset)
+	if err != nil {
+		return err
 	}
 
-	return errors.New("Init crypto profile first")
+	iv := make([]byte, BlockSize)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(body, body)
+
+	return nil
+}
+
+// decryptCBC decrypts data in place with zero IV, padding is left for the packet parser
+func decryptCBC(block cipher.Block, data *bytes.Buffer, offset int) error {
+	body, err := cbcBody(data, offset)
+	if err != nil {
+		return err
+	}
+
+	iv := make([]byte, BlockSize)
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(body, body)
+
+	return nil
+}
+
+func cbcBody(data *bytes.Buffer, offset int) ([]byte, error) {
+	if offset < 0 || offset > data.Len() {
+		return nil, errors.New("Offset is out of buffer")
+	}
+
+	body := data.Bytes()[offset:]
+	if len(body)%BlockSize != 0 {
+		return nil, &BlockSizeError{Length: len(body)}
+	}
+
+	return body, nil
 }
@@ -0,0 +1,63 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package crypto
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDefaultProfile(t *testing.T) {
+	Convey("Given a default profile", t, func() {
+		profile := &DefaultProfile{}
+		So(profile.InitDefault(), ShouldBeNil)
+
+		plain := []byte("0123456789abcdef0123456789abcdef0123456789abcdef")
+
+		Convey("Whole body should be encrypted in CBC mode", func() {
+			buff := bytes.NewBuffer(append([]byte{0x01, 0x02, 0x03, 0x04}, plain...))
+			So(profile.EncryptAt(buff, 4), ShouldBeNil)
+
+			body := buff.Bytes()[4:]
+			So(buff.Bytes()[:4], ShouldResemble, []byte{0x01, 0x02, 0x03, 0x04})
+			So(bytes.Contains(body, plain[16:32]), ShouldBeFalse)
+			So(body[16:32], ShouldNotResemble, body[32:48])
+
+			So(profile.DecryptAt(buff, 4), ShouldBeNil)
+			So(buff.Bytes()[4:], ShouldResemble, plain)
+		})
+
+		Convey("Unaligned body should be rejected with typed error", func() {
+			buff := bytes.NewBuffer(append([]byte{}, plain[:20]...))
+
+			err := profile.EncryptAt(buff, 0)
+			sizeErr, ok := err.(*BlockSizeError)
+			So(ok, ShouldBeTrue)
+			So(sizeErr.Length, ShouldEqual, 20)
+			So(buff.Bytes(), ShouldResemble, plain[:20])
+
+			_, ok = profile.DecryptAt(buff, 0).(*BlockSizeError)
+			So(ok, ShouldBeTrue)
+		})
+
+		Convey("Uninitialized profile should fail", func() {
+			So((&DefaultProfile{}).EncryptAt(bytes.NewBuffer(plain), 0), ShouldNotBeNil)
+		})
+	})
+}
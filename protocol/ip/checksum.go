@@ -17,37 +17,19 @@
 package ip
 
 import (
-	"bytes"
 	"encoding/binary"
 )
 
 // Checksum calculates IPv4 Header checksum from rfc1071
 func Checksum(b []byte) uint16 {
-	a := uint16(0)
-	buff := bytes.NewBuffer(b)
-	err := binary.Read(buff, binary.BigEndian, &a)
-	if err != nil {
-		return 0
-	}
-
 	acc := uint32(0)
 
-	for i := 0; i < len(b)/2; i++ {
-		err := binary.Read(buff, binary.BigEndian, &a)
-		if err != nil {
-			return 0
-		}
-
-		acc += uint32(a)
+	for i := 0; i+1 < len(b); i += 2 {
+		acc += uint32(binary.BigEndian.Uint16(b[i:]))
 	}
 
 	if len(b)%2 > 0 {
-		t, err := buff.ReadByte()
-		if err != nil {
-			return 0
-		}
-
-		acc += uint32(t)
+		acc += uint32(b[len(b)-1]) << 8
 	}
 
 	for acc>>16 != 0 {
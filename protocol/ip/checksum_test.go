@@ -37,5 +37,17 @@ func TestChecksum(t *testing.T) {
 		Convey("Checksum should be calculated properly", func() {
 			So(Checksum(data), ShouldEqual, 0x0000)
 		})
+
+		Convey("Checksum should match header checksum field", func() {
+			header := make([]byte, len(data))
+			copy(header, data)
+			header[10], header[11] = 0, 0
+
+			So(Checksum(header), ShouldEqual, 0xA2C4)
+		})
+
+		Convey("Odd length data should be padded with zero", func() {
+			So(Checksum([]byte{0x01, 0x02, 0x03}), ShouldEqual, ^uint16(0x0402))
+		})
 	})
 }
@@ -15,3 +15,49 @@
 //
 
 package protocol
+
+import (
+	"net"
+
+	"github.com/rtmfpew/rtmfpew/protocol/session"
+)
+
+// Mode defines endpoint role
+type Mode byte
+
+// Endpoint modes
+const (
+	// ClientMode endpoint initiates sessions with servers
+	ClientMode Mode = iota
+	// ServerMode endpoint accepts sessions from clients
+	ServerMode
+	// ServerlessMode endpoint both initiates and accepts sessions with peers
+	ServerlessMode
+)
+
+// Run binds UDP socket on host and starts endpoint runtime in the given mode
+func Run(host string, mode Mode) (*Context, error) {
+
+	addr, err := net.ResolveUDPAddr("udp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := newContext(conn, mode)
+
+	if mode != ClientMode {
+		if ctx.responder, err = session.NewResponder(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	ctx.start()
+
+	return ctx, nil
+}
@@ -0,0 +1,183 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package session
+
+import (
+	"errors"
+	"time"
+
+	"github.com/rtmfpew/rtmfpew/config"
+	"github.com/rtmfpew/rtmfpew/protocol/chunks"
+)
+
+// Session close reasons
+var (
+	ErrSessionClosed  = errors.New("Session is closed")
+	ErrClosedByFarEnd = errors.New("Session is closed by the far end")
+)
+
+// maxCloseRetransmitInterval is the longest interval between close requests
+const maxCloseRetransmitInterval = 5 * time.Second
+
+// Session states
+const (
+	stateOpen      = iota
+	stateNearClose // Close request is sent, waiting for acknowledgement
+	stateFarClose  // Far end closed session, its close requests are acknowledged until linger ends
+	stateClosed
+)
+
+// Close sends close request to the far end and retransmits it until
+// it's acknowledged or close timeout expires, Done is closed then.
+// Flows are aborted right away.
+func (session *Session) Close() error {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.state != stateOpen {
+		return ErrSessionClosed
+	}
+
+	now := time.Now()
+	session.state = stateNearClose
+	session.closeDeadline = now.Add(config.CloseTimeout())
+	session.closeRequestAt = now
+	session.closeRequestInterval = session.rto
+	session.outgoing.Init()
+	session.abortFlows(ErrSessionClosed)
+
+	return nil
+}
+
+// Closing returns true once session is closing or closed
+func (session *Session) Closing() bool {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	return session.state != stateOpen
+}
+
+// Done returns channel which is closed when session is closed
+func (session *Session) Done() <-chan struct{} {
+	return session.done
+}
+
+// Err returns reason the session is closed for or nil if it's open
+func (session *Session) Err() error {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	return session.closeErr
+}
+
+// close stops session with the reason, all the flows are aborted
+func (session *Session) close(reason error) {
+	if session.closeErr != nil {
+		return
+	}
+
+	session.state = stateClosed
+	session.closeErr = reason
+	session.outgoing.Init()
+	session.abortFlows(reason)
+
+	close(session.done)
+}
+
+// closing retransmits close request and closes session when close timeouts expire
+func (session *Session) closing(now time.Time) {
+	switch session.state {
+	case stateNearClose:
+		if !now.Before(session.closeDeadline) {
+			session.close(ErrSessionClosed)
+			return
+		}
+
+		if now.Before(session.closeRequestAt) {
+			return
+		}
+
+		session.outgoing.PushBack(&chunks.SessionCloseRequestChunk{})
+		session.closeRequestAt = now.Add(session.closeRequestInterval)
+
+		session.closeRequestInterval *= 2
+		if session.closeRequestInterval > maxCloseRetransmitInterval {
+			session.closeRequestInterval = maxCloseRetransmitInterval
+		}
+
+	case stateFarClose:
+		if !now.Before(session.closeDeadline) {
+			session.close(ErrClosedByFarEnd)
+		}
+	}
+}
+
+// handleCloseRequest acknowledges close request of the far end
+func (session *Session) handleCloseRequest(now time.Time) {
+	switch session.state {
+	case stateOpen:
+		session.state = stateFarClose
+		session.closeDeadline = now.Add(config.CloseLingerTimeout())
+		session.outgoing.Init()
+		session.abortFlows(ErrClosedByFarEnd)
+
+	case stateNearClose: // Both ends are closing
+		session.close(ErrSessionClosed)
+	}
+
+	session.outgoing.PushBack(&chunks.SessionCloseAcknowledgement{})
+}
+
+// handleCloseAck finishes close of the session
+func (session *Session) handleCloseAck() {
+	switch session.state {
+	case stateOpen, stateFarClose:
+		session.close(ErrClosedByFarEnd)
+	case stateNearClose:
+		session.close(ErrSessionClosed)
+	}
+}
+
+// handleClosingChunk handles chunks received while session is closing
+func (session *Session) handleClosingChunk(chnk Chunk) {
+	switch c := chnk.(type) {
+	case *chunks.SessionCloseRequestChunk:
+		session.handleCloseRequest(time.Now())
+	case *chunks.SessionCloseAcknowledgement:
+		session.handleCloseAck()
+	case *chunks.UserDataChunk:
+		session.rejectUserData(c)
+	case *chunks.NextUserDataChunk:
+		session.rejectUserData((*chunks.UserDataChunk)(c))
+	}
+}
+
+// rejectUserData refuses flows of the closing session
+func (session *Session) rejectUserData(chnk *chunks.UserDataChunk) {
+	session.outgoing.PushBack(&chunks.FlowExceptionReportChunk{FlowID: chnk.FlowID})
+}
+
+// abortFlows unblocks readers and writers of all the flows
+func (session *Session) abortFlows(reason error) {
+	for _, f := range session.recvFlows {
+		f.Close()
+	}
+
+	for _, f := range session.sendFlows {
+		f.Abort(reason)
+	}
+}
@@ -0,0 +1,130 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package session
+
+import (
+	"container/list"
+	"testing"
+	"time"
+
+	"github.com/rtmfpew/rtmfpew/protocol/chunks"
+	"github.com/rtmfpew/rtmfpew/protocol/connection/flow"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSessionClose(t *testing.T) {
+	Convey("Given two sessions with flows", t, func() {
+		a := New(&NormalSessionType{})
+		b := New(&NormalSessionType{})
+
+		exchange := func(from *Session, to *Session) []Chunk {
+			packets, err := from.Flush()
+			So(err, ShouldBeNil)
+
+			received := make([]Chunk, 0)
+			for _, packet := range packets {
+				pckt, err := to.ReadPacket(packet)
+				So(err, ShouldBeNil)
+
+				for e := pckt.Chunks.Front(); e != nil; e = e.Next() {
+					received = append(received, e.Value.(Chunk))
+				}
+
+				to.Receive(pckt, nil)
+			}
+
+			return received
+		}
+
+		fa := a.OpenFlow(nil)
+		fa.Write([]byte{0x01})
+		exchange(a, b)
+
+		fb := b.OpenFlow(nil)
+		recv := b.ReceiveFlow(fa.ID())
+
+		So(a.Close(), ShouldBeNil)
+		So(a.Close(), ShouldEqual, ErrSessionClosed)
+		So(a.Closing(), ShouldBeTrue)
+
+		Convey("Near end flows should be aborted", func() {
+			_, err := fa.Write([]byte{0x02})
+			So(err, ShouldEqual, ErrSessionClosed)
+			So(fa.Wait(), ShouldEqual, ErrSessionClosed)
+		})
+
+		Convey("Close request should be acknowledged", func() {
+			received := exchange(a, b)
+			So(received, ShouldResemble, []Chunk{&chunks.SessionCloseRequestChunk{}})
+			So(b.Closing(), ShouldBeTrue)
+			So(b.Err(), ShouldBeNil)
+
+			_, err := fb.Write([]byte{0x02})
+			So(err, ShouldEqual, ErrClosedByFarEnd)
+
+			_, err = recv.ReadMessage()
+			So(err, ShouldEqual, flow.ErrFlowClosed)
+
+			received = exchange(b, a)
+			So(received, ShouldResemble, []Chunk{&chunks.SessionCloseAcknowledgement{}})
+			So(a.Err(), ShouldEqual, ErrSessionClosed)
+			<-a.Done()
+
+			Convey("And retransmitted request should be acknowledged again", func() {
+				request := list.New()
+				request.PushBack(&chunks.SessionCloseRequestChunk{})
+
+				b.Receive(&Packet{Chunks: request}, nil)
+				So(b.outgoing.Front().Value, ShouldHaveSameTypeAs, &chunks.SessionCloseAcknowledgement{})
+			})
+
+			Convey("And far end should be closed after linger", func() {
+				b.closing(time.Now().Add(time.Minute))
+				So(b.Err(), ShouldEqual, ErrClosedByFarEnd)
+			})
+		})
+
+		Convey("Close request should be retransmitted until timeout", func() {
+			a.Flush()
+
+			packets, _ := a.Flush()
+			So(len(packets), ShouldEqual, 0)
+
+			a.closeRequestAt = time.Now()
+			packets, _ = a.Flush()
+			So(len(packets), ShouldEqual, 1)
+
+			a.closing(a.closeDeadline)
+			So(a.Err(), ShouldEqual, ErrSessionClosed)
+		})
+
+		Convey("Closing session should reject user data", func() {
+			fb.Write([]byte{0x02})
+			exchange(b, a)
+
+			So(a.outgoing.Back().Value, ShouldResemble, &chunks.FlowExceptionReportChunk{FlowID: fb.ID()})
+		})
+
+		Convey("Closed session shouldn't send anything", func() {
+			a.close(ErrSessionClosed)
+
+			packets, err := a.Flush()
+			So(err, ShouldBeNil)
+			So(len(packets), ShouldEqual, 0)
+		})
+	})
+}
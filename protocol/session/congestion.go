@@ -0,0 +1,208 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package session
+
+import (
+	"math"
+	"time"
+
+	"github.com/rtmfpew/rtmfpew/protocol/chunks"
+)
+
+// CongestionController limits user data in flight of a session.
+// It's called with session locked, so it isn't required to be safe for concurrent use.
+type CongestionController interface {
+	// Window returns how many bytes of user data can be in flight
+	Window() int
+
+	// OnAck is called with number of newly acknowledged bytes
+	OnAck(acked int, now time.Time)
+
+	// OnLoss is called when fragments are detected lost by later acknowledgements
+	OnLoss(now time.Time)
+
+	// OnTimeout is called when fragments are lost by retransmission timeout
+	OnTimeout(now time.Time)
+
+	// OnTimeCritical is called when time critical traffic of others is observed
+	OnTimeCritical(now time.Time)
+
+	// SetMSS is called when path MTU changes how much user data fits into a packet
+	SetMSS(mss int)
+}
+
+// timeCriticalTimeout is how long sender yields after time critical traffic of others is observed
+const timeCriticalTimeout = 800 * time.Millisecond
+
+func withinTimeCritical(last time.Time, now time.Time) bool {
+	return !last.IsZero() && now.Sub(last) < timeCriticalTimeout
+}
+
+// DefaultCongestionController is TCP compatible slow start and congestion avoidance
+// from RFC 7016 section 3.5.4. While others send time critical data it
+// backs off: window is halved, slow start is disabled and growth is four times slower.
+type DefaultCongestionController struct {
+	mss      int
+	cwnd     int
+	ssthresh int
+	acked    int // Bytes acknowledged since the last window increase in congestion avoidance
+
+	timeCritical time.Time // The last time others' time critical traffic was observed
+}
+
+// NewDefaultCongestionController creates controller for packets carrying up to mss bytes of user data
+func NewDefaultCongestionController(mss int) *DefaultCongestionController {
+	if mss <= 0 {
+		mss = 1
+	}
+
+	cwnd := 2 * mss
+	if cwnd < 4380 {
+		cwnd = 4380
+	}
+
+	if cwnd > 4*mss {
+		cwnd = 4 * mss
+	}
+
+	return &DefaultCongestionController{
+		mss:      mss,
+		cwnd:     cwnd,
+		ssthresh: math.MaxInt32,
+	}
+}
+
+// Window returns congestion window
+func (c *DefaultCongestionController) Window() int {
+	return c.cwnd
+}
+
+// OnAck grows window by acknowledged bytes in slow start, and by one
+// segment per window of acknowledged data in congestion avoidance
+func (c *DefaultCongestionController) OnAck(acked int, now time.Time) {
+	if acked <= 0 {
+		return
+	}
+
+	yielding := c.yielding(now)
+
+	if c.cwnd < c.ssthresh && !yielding {
+		if acked > c.mss {
+			acked = c.mss
+		}
+
+		c.cwnd += acked
+		return
+	}
+
+	threshold := c.cwnd
+	if yielding {
+		threshold *= 4
+	}
+
+	c.acked += acked
+	if c.acked >= threshold {
+		c.acked -= threshold
+		c.cwnd += c.mss
+	}
+}
+
+// OnLoss halves window
+func (c *DefaultCongestionController) OnLoss(now time.Time) {
+	c.backOff()
+	c.cwnd = c.ssthresh
+}
+
+// OnTimeout restarts slow start from a single segment
+func (c *DefaultCongestionController) OnTimeout(now time.Time) {
+	c.backOff()
+	c.cwnd = c.mss
+}
+
+// OnTimeCritical halves window when time critical traffic of others appears
+func (c *DefaultCongestionController) OnTimeCritical(now time.Time) {
+	if !c.yielding(now) {
+		c.backOff()
+		if c.cwnd > c.ssthresh {
+			c.cwnd = c.ssthresh
+		}
+	}
+
+	c.timeCritical = now
+}
+
+// SetMSS changes segment size window is grown and restarted by
+func (c *DefaultCongestionController) SetMSS(mss int) {
+	if mss <= 0 {
+		mss = 1
+	}
+
+	c.mss = mss
+}
+
+func (c *DefaultCongestionController) backOff() {
+	c.ssthresh = c.cwnd / 2
+	if c.ssthresh < 2*c.mss {
+		c.ssthresh = 2 * c.mss
+	}
+
+	c.acked = 0
+}
+
+func (c *DefaultCongestionController) yielding(now time.Time) bool {
+	return withinTimeCritical(c.timeCritical, now)
+}
+
+// SendsTimeCritical returns true if session has sent time critical data recently
+func (session *Session) SendsTimeCritical(now time.Time) bool {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	return withinTimeCritical(session.tcSent, now)
+}
+
+// TimeCriticalObserved notifies session about time critical traffic of the other
+// sessions of the host, received is true when it came from the far end
+func (session *Session) TimeCriticalObserved(received bool, now time.Time) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if received {
+		session.tcRecv = now
+	}
+
+	session.yieldTimeCritical(now)
+}
+
+// yieldTimeCritical makes congestion control less aggressive
+// unless session sends time critical data itself
+func (session *Session) yieldTimeCritical(now time.Time) {
+	if !withinTimeCritical(session.tcSent, now) {
+		session.congestion.OnTimeCritical(now)
+	}
+}
+
+// isTimeCritical returns true if chunk is user data of time critical flow
+func (session *Session) isTimeCritical(chnk Chunk) bool {
+	data, ok := chnk.(*chunks.UserDataChunk)
+	if !ok {
+		return false
+	}
+
+	f := session.sendFlows[data.FlowID]
+	return f != nil && f.TimeCritical()
+}
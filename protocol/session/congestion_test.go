@@ -0,0 +1,81 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package session
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDefaultCongestionController(t *testing.T) {
+	Convey("Given default congestion controller", t, func() {
+		mss := 1000
+		c := NewDefaultCongestionController(mss)
+		now := time.Now()
+
+		So(c.Window(), ShouldEqual, 4000)
+
+		Convey("Window should grow by a segment per acknowledgement in slow start", func() {
+			c.OnAck(mss, now)
+			c.OnAck(mss, now)
+			So(c.Window(), ShouldEqual, 6000)
+		})
+
+		Convey("Window should be halved on loss and grow linearly after it", func() {
+			c.OnLoss(now)
+			So(c.Window(), ShouldEqual, 2000)
+
+			c.OnAck(mss, now)
+			So(c.Window(), ShouldEqual, 2000)
+
+			c.OnAck(mss, now)
+			So(c.Window(), ShouldEqual, 3000)
+		})
+
+		Convey("Window should collapse to a single segment on timeout", func() {
+			c.OnTimeout(now)
+			So(c.Window(), ShouldEqual, mss)
+
+			c.OnAck(mss, now)
+			So(c.Window(), ShouldEqual, 2*mss)
+		})
+
+		Convey("Time critical traffic of others should slow growth down", func() {
+			c.OnTimeCritical(now)
+			So(c.Window(), ShouldEqual, 2000)
+
+			c.OnTimeCritical(now)
+			So(c.Window(), ShouldEqual, 2000)
+
+			c.OnAck(mss, now)
+			c.OnAck(mss, now)
+			So(c.Window(), ShouldEqual, 2000)
+
+			c.OnAck(6*mss, now)
+			So(c.Window(), ShouldEqual, 3000)
+
+			Convey("And slow start should resume after a while", func() {
+				later := now.Add(timeCriticalTimeout)
+				c.OnTimeout(later)
+				c.OnAck(mss, later)
+				So(c.Window(), ShouldEqual, 2*mss)
+			})
+		})
+	})
+}
@@ -15,3 +15,190 @@
 //
 
 package session
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rtmfpew/rtmfpew/config"
+	"github.com/rtmfpew/rtmfpew/protocol/connection"
+)
+
+// Cookie layout: generation, issue time, tag length, tag, initiator address and HMAC-SHA256 of all that
+const (
+	cookieHeaderLength = 1 + 4 + 1
+	cookieSecretLength = 32
+)
+
+// Cookie verification errors
+var (
+	ErrInvalidCookie        = errors.New("Cookie is not valid")
+	ErrExpiredCookie        = errors.New("Cookie is expired")
+	ErrCookieAddressChanged = errors.New("Cookie was minted for another initiator address")
+)
+
+// CookieJar mints and verifies responder hello cookies without keeping per-initiator state.
+// Secret is rotated every Lifetime, cookies minted with the previous secret are still accepted.
+type CookieJar struct {
+	Lifetime time.Duration
+
+	mu         sync.Mutex
+	generation byte
+	secret     []byte
+	previous   []byte
+	rotateAt   time.Time
+}
+
+// NewCookieJar creates cookie jar with fresh secret
+func NewCookieJar() (*CookieJar, error) {
+	jar := &CookieJar{
+		Lifetime: config.CookieLifetime(),
+	}
+
+	if err := jar.Rotate(time.Now()); err != nil {
+		return nil, err
+	}
+
+	return jar, nil
+}
+
+// Rotate replaces cookie secret, the current one becomes previous
+func (jar *CookieJar) Rotate(now time.Time) error {
+	secret := make([]byte, cookieSecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+
+	jar.mu.Lock()
+	defer jar.mu.Unlock()
+
+	jar.previous = jar.secret
+	jar.secret = secret
+	jar.generation++
+	jar.rotateAt = now.Add(jar.Lifetime)
+
+	return nil
+}
+
+// Poll rotates secret when it's time to
+func (jar *CookieJar) Poll(now time.Time) error {
+	jar.mu.Lock()
+	due := !now.Before(jar.rotateAt)
+	jar.mu.Unlock()
+
+	if due {
+		return jar.Rotate(now)
+	}
+
+	return nil
+}
+
+// Mint creates cookie binding initiator address and tag
+func (jar *CookieJar) Mint(addr *net.UDPAddr, tag []byte, now time.Time) []byte {
+	jar.mu.Lock()
+	generation, secret := jar.generation, jar.secret
+	jar.mu.Unlock()
+
+	if len(tag) > 0xFF {
+		tag = tag[:0xFF]
+	}
+
+	buff := bytes.NewBuffer(make([]byte, 0, cookieHeaderLength+len(tag)+19+sha256.Size))
+	buff.WriteByte(generation)
+	binary.Write(buff, binary.BigEndian, uint32(now.Unix()))
+	buff.WriteByte(byte(len(tag)))
+	buff.Write(tag)
+	connection.PeerAddressFrom(addr).WriteTo(buff)
+
+	buff.Write(cookieMac(secret, buff.Bytes()))
+
+	return buff.Bytes()
+}
+
+// Verify checks that cookie was minted by this jar for the initiator at addr and returns it's tag.
+// ErrCookieAddressChanged is returned for valid cookies minted for another address.
+func (jar *CookieJar) Verify(cookie []byte, addr *net.UDPAddr, now time.Time) ([]byte, error) {
+	tag, minted, err := jar.open(cookie, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if !minted.IP.Equal(addr.IP) || minted.Port != addr.Port {
+		return tag, ErrCookieAddressChanged
+	}
+
+	return tag, nil
+}
+
+// Remint creates cookie for the new initiator address out of a valid cookie minted for the old one
+func (jar *CookieJar) Remint(cookie []byte, addr *net.UDPAddr, now time.Time) ([]byte, error) {
+	tag, err := jar.Verify(cookie, addr, now)
+	if err != ErrCookieAddressChanged {
+		if err == nil {
+			return nil, errors.New("Initiator address is not changed")
+		}
+
+		return nil, err
+	}
+
+	return jar.Mint(addr, tag, now), nil
+}
+
+// open checks cookie MAC and lifetime, then unpacks it's tag and initiator address
+func (jar *CookieJar) open(cookie []byte, now time.Time) ([]byte, *net.UDPAddr, error) {
+	if len(cookie) < cookieHeaderLength+sha256.Size {
+		return nil, nil, ErrInvalidCookie
+	}
+
+	jar.mu.Lock()
+	var secret []byte
+	switch cookie[0] {
+	case jar.generation:
+		secret = jar.secret
+	case jar.generation - 1:
+		secret = jar.previous
+	}
+	jar.mu.Unlock()
+
+	if secret == nil {
+		return nil, nil, ErrInvalidCookie
+	}
+
+	data := cookie[:len(cookie)-sha256.Size]
+	if !hmac.Equal(cookie[len(data):], cookieMac(secret, data)) {
+		return nil, nil, ErrInvalidCookie
+	}
+
+	issued := time.Unix(int64(binary.BigEndian.Uint32(data[1:5])), 0)
+	if now.Sub(issued) > jar.Lifetime {
+		return nil, nil, ErrExpiredCookie
+	}
+
+	tagLength := int(data[cookieHeaderLength-1])
+	if len(data) < cookieHeaderLength+tagLength {
+		return nil, nil, ErrInvalidCookie
+	}
+
+	tag := data[cookieHeaderLength : cookieHeaderLength+tagLength]
+
+	minted := &connection.PeerAddress{}
+	if err := minted.ReadFrom(bytes.NewBuffer(data[cookieHeaderLength+tagLength:])); err != nil {
+		return nil, nil, ErrInvalidCookie
+	}
+
+	return tag, minted.UDPAddr(), nil
+}
+
+func cookieMac(secret []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(data)
+
+	return mac.Sum(nil)
+}
@@ -0,0 +1,107 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package session
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCookieJar(t *testing.T) {
+	Convey("Given a cookie jar and a cookie", t, func() {
+		jar, err := NewCookieJar()
+		So(err, ShouldBeNil)
+
+		addr, _ := net.ResolveUDPAddr("udp", "53.13.1.45:1935")
+		tag := []byte{0x1A, 0xB2, 0xBA, 0xDC, 0xED}
+		now := time.Now()
+
+		cookie := jar.Mint(addr, tag, now)
+
+		Convey("It should be verified for the same address", func() {
+			verifiedTag, err := jar.Verify(cookie, addr, now)
+			So(err, ShouldBeNil)
+			So(verifiedTag, ShouldResemble, tag)
+		})
+
+		Convey("It should be detected as minted for another address", func() {
+			other, _ := net.ResolveUDPAddr("udp", "53.13.1.45:1936")
+
+			_, err := jar.Verify(cookie, other, now)
+			So(err, ShouldEqual, ErrCookieAddressChanged)
+		})
+
+		Convey("It should be reminted for a new address", func() {
+			other, _ := net.ResolveUDPAddr("udp", "53.13.1.46:1935")
+
+			fresh, err := jar.Remint(cookie, other, now)
+			So(err, ShouldBeNil)
+			So(fresh, ShouldNotResemble, cookie)
+
+			verifiedTag, err := jar.Verify(fresh, other, now)
+			So(err, ShouldBeNil)
+			So(verifiedTag, ShouldResemble, tag)
+
+			_, err = jar.Remint(cookie, addr, now)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("It should be rejected when tampered", func() {
+			cookie[2] ^= 0x01
+
+			_, err := jar.Verify(cookie, addr, now)
+			So(err, ShouldEqual, ErrInvalidCookie)
+
+			_, err = jar.Verify(cookie[:10], addr, now)
+			So(err, ShouldEqual, ErrInvalidCookie)
+		})
+
+		Convey("It should expire", func() {
+			_, err := jar.Verify(cookie, addr, now.Add(jar.Lifetime+time.Second))
+			So(err, ShouldEqual, ErrExpiredCookie)
+		})
+
+		Convey("It should survive one secret rotation only", func() {
+			So(jar.Rotate(now), ShouldBeNil)
+
+			_, err := jar.Verify(cookie, addr, now)
+			So(err, ShouldBeNil)
+
+			So(jar.Rotate(now), ShouldBeNil)
+
+			_, err = jar.Verify(cookie, addr, now)
+			So(err, ShouldEqual, ErrInvalidCookie)
+		})
+
+		Convey("Secret should be rotated on schedule", func() {
+			So(jar.Poll(now.Add(jar.Lifetime/2)), ShouldBeNil)
+			So(jar.Poll(now.Add(jar.Lifetime/2)), ShouldBeNil)
+
+			_, err := jar.Verify(cookie, addr, now)
+			So(err, ShouldBeNil)
+
+			So(jar.Poll(now.Add(jar.Lifetime)), ShouldBeNil)
+			So(jar.Poll(now.Add(2*jar.Lifetime)), ShouldBeNil)
+
+			_, err = jar.Verify(cookie, addr, now)
+			So(err, ShouldEqual, ErrInvalidCookie)
+		})
+	})
+}
@@ -0,0 +1,343 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package session
+
+import (
+	"container/list"
+	"errors"
+	"time"
+
+	"github.com/rtmfpew/amfy/vlu"
+	"github.com/rtmfpew/rtmfpew/config"
+	"github.com/rtmfpew/rtmfpew/protocol/chunks"
+	"github.com/rtmfpew/rtmfpew/protocol/connection/flow"
+)
+
+// userDataOverhead is the worst case size of user data chunk without user data:
+// type, length, flags, flow ID, sequence number and FSN offset
+const userDataOverhead = 1 + 2 + 1 + 3*5
+
+// Flows returns all the open flows of the session
+func (session *Session) Flows() []flow.Flow {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	flows := make([]flow.Flow, 0, len(session.sendFlows)+len(session.recvFlows))
+	for _, f := range session.sendFlows {
+		flows = append(flows, f)
+	}
+
+	for _, f := range session.recvFlows {
+		flows = append(flows, f)
+	}
+
+	return flows
+}
+
+// OpenFlow creates a new flow sending messages to the far end, metadata
+// lets the far end tell flows apart before any data is read, it may be nil
+func (session *Session) OpenFlow(metadata []byte) *flow.SendFlow {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	return session.openFlow(flowOptions(metadata))
+}
+
+// OpenReturnFlow opens send flow with metadata in return to the far end
+// flow ID, the far end sees it associated with that flow
+func (session *Session) OpenReturnFlow(metadata []byte, ID vlu.Vlu) *flow.SendFlow {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	return session.openFlow(flowOptions(metadata, flow.ReturnFlowAssociation(ID)))
+}
+
+// flowOptions puts metadata option first if there is metadata
+func flowOptions(metadata []byte, options ...chunks.UserDataOption) []chunks.UserDataOption {
+	if metadata == nil {
+		return options
+	}
+
+	return append([]chunks.UserDataOption{flow.PerFlowMetadata(metadata)}, options...)
+}
+
+func (session *Session) openFlow(options []chunks.UserDataOption) *flow.SendFlow {
+	f := flow.NewSendFlowWithOptions(session.nextFlowID, session.MSS(), options)
+	session.sendFlows[f.ID()] = f
+	session.nextFlowID++
+
+	return f
+}
+
+// FlowAcceptor is called when the far end opens a new flow. Associated is
+// the near end send flow it's returned for, it's nil for unassociated flows.
+type FlowAcceptor func(f *flow.ReceiveFlow, associated *flow.SendFlow)
+
+// SetFlowAcceptor sets handler of the flows opened by the far end,
+// flows opened before it's set are passed to it right away
+func (session *Session) SetFlowAcceptor(acceptor FlowAcceptor) {
+	session.mu.Lock()
+	session.acceptor = acceptor
+	accepted := session.takeAccepted()
+	session.mu.Unlock()
+
+	acceptFlows(acceptor, accepted)
+}
+
+// takeAccepted returns new flows for the acceptor, they are kept until it's set
+func (session *Session) takeAccepted() []*acceptedFlow {
+	if session.acceptor == nil {
+		return nil
+	}
+
+	accepted := session.accepted
+	session.accepted = nil
+	return accepted
+}
+
+// acceptFlows passes new flows to the acceptor, it's called with session unlocked
+func acceptFlows(acceptor FlowAcceptor, accepted []*acceptedFlow) {
+	for _, a := range accepted {
+		acceptor(a.flow, a.associated)
+	}
+}
+
+// acceptedFlow is a new flow waiting to be passed to the acceptor
+type acceptedFlow struct {
+	flow       *flow.ReceiveFlow
+	associated *flow.SendFlow
+}
+
+// ReceiveFlow returns flow opened by the far end or nil
+func (session *Session) ReceiveFlow(ID vlu.Vlu) *flow.ReceiveFlow {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	return session.recvFlows[ID]
+}
+
+func (session *Session) handleUserData(chnk *chunks.UserDataChunk) {
+	f := session.recvFlows[chnk.FlowID]
+	if f == nil {
+		f = flow.NewReceiveFlow(chnk.FlowID)
+		session.recvFlows[chnk.FlowID] = f
+		defer session.acceptFlow(f)
+	}
+
+	f.Receive(chnk)
+}
+
+// reapFlows forgets finished receive flows once they lingered
+// long enough to acknowledge retransmitted final fragments
+func (session *Session) reapFlows(now time.Time) {
+	for ID, f := range session.recvFlows {
+		if !f.Finished() {
+			continue
+		}
+
+		deadline, ok := session.lingering[ID]
+		if !ok {
+			session.lingering[ID] = now.Add(config.FlowLingerTimeout())
+			continue
+		}
+
+		if !now.Before(deadline) {
+			delete(session.recvFlows, ID)
+			delete(session.lingering, ID)
+		}
+	}
+}
+
+// acceptFlow queues new flow for the acceptor with the send flow it's associated with
+func (session *Session) acceptFlow(f *flow.ReceiveFlow) {
+	a := &acceptedFlow{flow: f}
+	if ID, ok := f.ReturnFlowID(); ok {
+		a.associated = session.sendFlows[ID]
+	}
+
+	session.accepted = append(session.accepted, a)
+}
+
+// MSS returns how many bytes of user data fit into a single packet
+func (session *Session) MSS() int {
+	return int(session.mtu) - packetOverhead - userDataOverhead
+}
+
+// SetCongestionController replaces default congestion control
+func (session *Session) SetCongestionController(c CongestionController) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	session.congestion = c
+}
+
+// drainFlows abandons expired messages and queues fragments of the send
+// flows in order of their priorities as long as congestion window allows
+func (session *Session) drainFlows() {
+	now := time.Now()
+
+	timedOut := false
+	inFlight := 0
+	for _, f := range session.sendFlows {
+		f.Abandon(now)
+
+		if f.Timeout(now, session.rto) > 0 {
+			timedOut = true
+		}
+
+		inFlight += f.InFlight()
+
+		if f.NeedsProbe(now, session.rto) {
+			session.outgoing.PushBack(&chunks.BufferProbeChunk{FlowID: f.ID()})
+		}
+	}
+
+	if timedOut { // Back off until acknowledgements come
+		session.congestion.OnTimeout(now)
+		session.mtuLost(now)
+
+		session.rto *= 2
+		if limit := config.MaxRetransmitTimeout(); session.rto > limit {
+			session.rto = limit
+		}
+	}
+
+	budget := session.congestion.Window() - inFlight
+	for _, chnk := range session.scheduler.schedule(session.sendFlows, budget) {
+		session.outgoing.PushBack(chnk)
+	}
+
+	for ID, f := range session.sendFlows {
+		if f.Finished() {
+			delete(session.sendFlows, ID)
+		}
+	}
+}
+
+// handleException closes send flow rejected by the far end
+func (session *Session) handleException(chnk *chunks.FlowExceptionReportChunk) {
+	if f := session.sendFlows[chnk.FlowID]; f != nil {
+		f.HandleException(chnk.Exception)
+	}
+}
+
+func (session *Session) handleAck(ID vlu.Vlu, ack flow.AckChunk) {
+	f := session.sendFlows[ID]
+	if f == nil {
+		return
+	}
+
+	acked, lost, err := f.HandleAck(ack)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	if acked > 0 {
+		session.rto = session.rtt.timeout()
+		session.congestion.OnAck(acked, now)
+		session.pmtu.losses = 0
+	}
+
+	if lost > 0 {
+		session.congestion.OnLoss(now)
+	}
+}
+
+// nextUserData replaces user data chunk following the previous one
+// in the packet with the shorter next user data chunk
+func nextUserData(prev *list.Element, chnk Chunk) Chunk {
+	data, ok := chnk.(*chunks.UserDataChunk)
+	if !ok || prev == nil {
+		return chnk
+	}
+
+	var last *chunks.UserDataChunk
+	switch c := prev.Value.(type) {
+	case *chunks.UserDataChunk:
+		last = c
+	case *chunks.NextUserDataChunk:
+		last = (*chunks.UserDataChunk)(c)
+	default:
+		return chnk
+	}
+
+	if next := (*chunks.NextUserDataChunk)(data); next.Follows(last) {
+		return next
+	}
+
+	return chnk
+}
+
+// followUserData fills fields of the next user data chunk from the previous chunk in the packet
+func followUserData(chnk *chunks.NextUserDataChunk, prev *list.Element) error {
+	if prev != nil {
+		switch c := prev.Value.(type) {
+		case *chunks.UserDataChunk:
+			chnk.Follow(c)
+			return nil
+		case *chunks.NextUserDataChunk:
+			chnk.Follow((*chunks.UserDataChunk)(c))
+			return nil
+		}
+	}
+
+	return errors.New("Next user data chunk doesn't follow user data")
+}
+
+// receivedUserData starts delayed acknowledgement timer
+func (session *Session) receivedUserData(now time.Time) {
+	session.ackPackets++
+
+	if session.ackDeadline.IsZero() {
+		session.ackDeadline = now.Add(config.DelayedAckTimeout())
+	}
+}
+
+// queueAcks acknowledges every second packet with user data, out of order
+// and duplicated fragments right away, and the rest by delayed ack timeout
+func (session *Session) queueAcks(now time.Time) {
+	immediate := session.ackPackets >= 2 ||
+		(!session.ackDeadline.IsZero() && !now.Before(session.ackDeadline))
+
+	for _, f := range session.recvFlows {
+		if pending, right := f.NeedsAck(); pending && right {
+			immediate = true
+			break
+		}
+	}
+
+	if !immediate {
+		return
+	}
+
+	for _, f := range session.recvFlows {
+		if pending, _ := f.NeedsAck(); pending {
+			session.outgoing.PushBack(f.Acknowledgement())
+
+			if exception := f.Exception(); exception != nil { // Rejection follows every ack
+				session.outgoing.PushBack(&chunks.FlowExceptionReportChunk{
+					FlowID:    f.ID(),
+					Exception: exception.Code,
+				})
+			}
+		}
+	}
+
+	session.ackPackets = 0
+	session.ackDeadline = time.Time{}
+}
@@ -0,0 +1,240 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package session
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/rtmfpew/amfy/vlu"
+	"github.com/rtmfpew/rtmfpew/protocol/chunks"
+)
+
+// fragmentOverhead is the worst case size of fragment chunk header:
+// type, length, flags, packet ID and fragment number
+const fragmentOverhead = 1 + 2 + 1 + 5 + 5
+
+// maxReassemblies is a number of fragmented packets reassembled at once,
+// the oldest one is dropped to make room for a new one
+const maxReassemblies = 8
+
+// packetIDs numbers fragmented packets, startup packets are written by
+// short lived sessions so the counter is shared
+var packetIDs uint32
+
+// reassembly collects fragments of a single packet
+type reassembly struct {
+	fragments map[vlu.Vlu][]byte
+	size      int
+	next      vlu.Vlu // The first missing fragment
+	last      vlu.Vlu // The fragment without more fragments flag
+	hasLast   bool
+	deadline  time.Time
+}
+
+// complete tells if all the fragments up to the last one are received
+func (r *reassembly) complete() bool {
+	return r.hasLast && r.next > r.last
+}
+
+// bytes concatenates fragments in order
+func (r *reassembly) bytes() []byte {
+	data := make([]byte, 0, r.size)
+	for num := vlu.Vlu(0); num <= r.last; num++ {
+		data = append(data, r.fragments[num]...)
+	}
+
+	return data
+}
+
+// fragmentChunks splits chunks into fragments each fitting into a packet of mtu size
+func fragmentChunks(chnks *list.List, mtu uint16) (*list.List, error) {
+	buff := bytes.NewBuffer(make([]byte, 0, mtu))
+	for c := chnks.Front(); c != nil; c = c.Next() {
+		if err := c.Value.(Chunk).WriteTo(buff); err != nil {
+			return nil, err
+		}
+	}
+
+	data := buff.Bytes()
+	size := int(mtu) - packetOverhead - fragmentOverhead
+	pcktID := vlu.Vlu(atomic.AddUint32(&packetIDs, 1))
+
+	fragments := list.New()
+	for num := vlu.Vlu(0); len(data) > 0; num++ {
+		l := size
+		if l > len(data) {
+			l = len(data)
+		}
+
+		fragments.PushBack(&chunks.FragmentChunk{
+			MoreFragments: l < len(data),
+			PacketID:      pcktID,
+			FragmentNum:   num,
+			Fragment:      data[:l],
+		})
+
+		data = data[l:]
+	}
+
+	return fragments, nil
+}
+
+// writeFragments writes packet too large for the mtu as a sequence of packets with fragment chunks
+func (session *Session) writeFragments(pckt Packet) ([]*bytes.Buffer, error) {
+	fragments, err := fragmentChunks(pckt.Chunks, session.mtu)
+	if err != nil {
+		return nil, err
+	}
+
+	packets := make([]*bytes.Buffer, 0, fragments.Len())
+	for f := fragments.Front(); f != nil; f = f.Next() {
+		fragment := pckt
+		fragment.Chunks = list.New()
+		fragment.Chunks.PushBack(f.Value)
+
+		buff := bytes.NewBuffer(make([]byte, 0, session.mtu))
+		if err = session.writePacket(fragment, buff, session.mtu); err != nil {
+			return packets, err
+		}
+
+		packets = append(packets, buff)
+	}
+
+	return packets, nil
+}
+
+// reassemble stores the fragment and returns chunks data of the packet once
+// all of it's fragments are received. Fragments may arrive in any order and
+// duplicates are ignored, but a fragment more than maxFragmentationGap ahead
+// of the first missing one drops the whole packet.
+func (session *Session) reassemble(c *chunks.FragmentChunk, now time.Time) ([]byte, error) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	session.expireFragments(now)
+
+	r := session.fragments[c.PacketID]
+	if r == nil {
+		if len(session.fragments) >= maxReassemblies {
+			session.dropOldestFragments()
+		}
+
+		r = &reassembly{
+			fragments: make(map[vlu.Vlu][]byte),
+			deadline:  now.Add(reassemblyTimeout),
+		}
+		session.fragments[c.PacketID] = r
+	}
+
+	if _, ok := r.fragments[c.FragmentNum]; ok {
+		return nil, nil
+	}
+
+	if c.FragmentNum < r.next { // Already reassembled part
+		return nil, nil
+	}
+
+	if uint64(c.FragmentNum-r.next) > uint64(maxFragmentationGap) {
+		delete(session.fragments, c.PacketID)
+		return nil, errors.New("Too large fragmentation gap")
+	}
+
+	if (r.hasLast && c.FragmentNum > r.last) || (!c.MoreFragments && r.hasLast) {
+		delete(session.fragments, c.PacketID)
+		return nil, errors.New("Fragment after the last one")
+	}
+
+	if !c.MoreFragments {
+		for num := range r.fragments {
+			if num > c.FragmentNum {
+				delete(session.fragments, c.PacketID)
+				return nil, errors.New("Fragment after the last one")
+			}
+		}
+
+		r.hasLast = true
+		r.last = c.FragmentNum
+	}
+
+	r.fragments[c.FragmentNum] = c.Fragment
+	r.size += len(c.Fragment)
+
+	if len(r.fragments) > maxFragments {
+		delete(session.fragments, c.PacketID)
+		return nil, errors.New("Too many fragments in the packet")
+	}
+
+	if r.size > int(maxFragmentsSize) {
+		delete(session.fragments, c.PacketID)
+		return nil, errors.New("Too long fragmentated packet")
+	}
+
+	for _, ok := r.fragments[r.next]; ok; _, ok = r.fragments[r.next] {
+		r.next++
+	}
+
+	if !r.complete() {
+		return nil, nil
+	}
+
+	delete(session.fragments, c.PacketID)
+
+	return r.bytes(), nil
+}
+
+// expireFragments drops packets not reassembled in time, caller must hold the lock
+func (session *Session) expireFragments(now time.Time) {
+	for ID, r := range session.fragments {
+		if !now.Before(r.deadline) {
+			delete(session.fragments, ID)
+		}
+	}
+}
+
+// dropOldestFragments drops the packet reassembled for the longest time, caller must hold the lock
+func (session *Session) dropOldestFragments() {
+	var oldest *reassembly
+	oldestID := vlu.Vlu(0)
+
+	for ID, r := range session.fragments {
+		if oldest == nil || r.deadline.Before(oldest.deadline) {
+			oldest, oldestID = r, ID
+		}
+	}
+
+	delete(session.fragments, oldestID)
+}
+
+// ExpireFragments drops fragmented packets not reassembled in time
+func (session *Session) ExpireFragments(now time.Time) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	session.expireFragments(now)
+}
+
+// Reassembling tells if session waits for fragments of any packet
+func (session *Session) Reassembling() bool {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	return len(session.fragments) > 0
+}
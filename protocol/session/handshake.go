@@ -16,12 +16,357 @@
 
 package session
 
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rtmfpew/rtmfpew/config"
+	"github.com/rtmfpew/rtmfpew/protocol/chunks"
+	"github.com/rtmfpew/rtmfpew/protocol/connection"
+	"github.com/rtmfpew/rtmfpew/protocol/crypto"
+)
+
+// TagLength is a length of the initiator hello tag
+const TagLength = 16
+
 const (
-	handshakeHelloState = 0
+	handshakeHelloState = iota
 	handshakeKeyingState
+	handshakeDoneState
+	handshakeFailedState
 )
 
 // HandshakeSessionType stores handshake state and validates chunk types
 type HandshakeSessionType struct {
 	state uint16
 }
+
+// IsValidChunkType checks if chunk is expected in the current handshake state
+func (t *HandshakeSessionType) IsValidChunkType(typ byte) bool {
+	switch t.state {
+	case handshakeHelloState:
+		return typ == chunks.ResponderHelloChunkType
+	case handshakeKeyingState:
+		return typ == chunks.ResponderInitialKeyingChunkType ||
+			typ == chunks.HelloCookieChangeChunkType
+	}
+
+	return false
+}
+
+// GotChunkType moves handshake to the next state
+func (t *HandshakeSessionType) GotChunkType(typ byte) {
+	if !t.IsValidChunkType(typ) {
+		return
+	}
+
+	switch typ {
+	case chunks.ResponderHelloChunkType:
+		t.state = handshakeKeyingState
+	case chunks.ResponderInitialKeyingChunkType:
+		t.state = handshakeDoneState
+	}
+}
+
+// NextType returns established session type once handshake is done
+func (t *HandshakeSessionType) NextType() SessionType {
+	if t.state == handshakeDoneState {
+		return &NormalSessionType{}
+	}
+
+	return t
+}
+
+// HandshakeTimeoutError is returned when far end didn't complete handshake in time
+type HandshakeTimeoutError struct {
+	Addr     *net.UDPAddr
+	Attempts int
+}
+
+func (err *HandshakeTimeoutError) Error() string {
+	return fmt.Sprintf("Handshake with %s timed out after %d attempts", err.Addr, err.Attempts)
+}
+
+// Timeout is always true, makes HandshakeTimeoutError a net.Error
+func (err *HandshakeTimeoutError) Timeout() bool {
+	return true
+}
+
+// Temporary is always true, makes HandshakeTimeoutError a net.Error
+func (err *HandshakeTimeoutError) Temporary() bool {
+	return true
+}
+
+// Initiator drives the initiator side of the four-way handshake
+type Initiator struct {
+	Type HandshakeSessionType
+
+	Epd         []byte
+	Tag         []byte
+	Certificate *crypto.Certificate
+	SessionID   uint32 // Near end ID of the session beeing established
+
+	Timeout            time.Duration
+	RetransmitInterval time.Duration
+
+	mu       sync.Mutex
+	addr     *net.UDPAddr
+	cookie   []byte
+	profile  crypto.KeyAgreement
+	skic     []byte
+	attempts int
+	interval time.Duration
+	next     time.Time
+	deadline time.Time
+
+	session *Session
+	err     error
+	done    chan struct{}
+}
+
+// NewInitiator creates handshake with the far end at addr
+func NewInitiator(addr *net.UDPAddr, epd []byte, ID uint32) (*Initiator, error) {
+	tag := make([]byte, TagLength)
+	if _, err := rand.Read(tag); err != nil {
+		return nil, err
+	}
+
+	profile, err := crypto.NewFlashProfile()
+	if err != nil {
+		return nil, err
+	}
+
+	skic, err := profile.InitiatorComponent()
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := crypto.NewCertificate()
+	if err != nil {
+		return nil, err
+	}
+
+	in := &Initiator{
+		addr:               addr,
+		Epd:                epd,
+		Tag:                tag,
+		Certificate:        cert,
+		SessionID:          ID,
+		Timeout:            config.HandshakeTimeout(),
+		RetransmitInterval: config.HandshakeRetransmitInterval(),
+		profile:            profile,
+		skic:               skic,
+		done:               make(chan struct{}),
+	}
+
+	return in, nil
+}
+
+// Addr returns far end address, it's changed by responder hello
+func (in *Initiator) Addr() *net.UDPAddr {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	return in.addr
+}
+
+// Done is closed when handshake is completed or failed
+func (in *Initiator) Done() <-chan struct{} {
+	return in.done
+}
+
+// Result returns established session or handshake error
+func (in *Initiator) Result() (*Session, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	return in.session, in.err
+}
+
+// Poll returns chunk to be (re)sent at the moment if any.
+// Retransmission interval is doubled on each attempt.
+func (in *Initiator) Poll(now time.Time) (Chunk, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if in.err != nil {
+		return nil, in.err
+	}
+
+	if in.deadline.IsZero() {
+		in.deadline = now.Add(in.Timeout)
+		in.interval = in.RetransmitInterval
+		in.next = now
+	}
+
+	if !now.Before(in.deadline) {
+		in.fail(&HandshakeTimeoutError{
+			Addr:     in.addr,
+			Attempts: in.attempts,
+		})
+
+		return nil, in.err
+	}
+
+	if now.Before(in.next) {
+		return nil, nil
+	}
+
+	in.attempts++
+	in.next = now.Add(in.interval)
+	in.interval *= 2
+
+	switch in.Type.state {
+	case handshakeHelloState:
+		return in.hello(), nil
+	case handshakeKeyingState:
+		return in.keying(), nil
+	}
+
+	return nil, nil
+}
+
+// Cancel aborts handshake with err
+func (in *Initiator) Cancel(err error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	in.fail(err)
+}
+
+func (in *Initiator) fail(err error) {
+	if in.err != nil || in.session != nil {
+		return
+	}
+
+	in.err = err
+	in.Type.state = handshakeFailedState
+	close(in.done)
+}
+
+func (in *Initiator) hello() *chunks.InitiatorHelloChunk {
+	return &chunks.InitiatorHelloChunk{
+		Epd: in.Epd,
+		Tag: in.Tag,
+	}
+}
+
+func (in *Initiator) keying() *chunks.InitiatorInitialKeyingChunk {
+	cert, _ := in.Certificate.Bytes()
+
+	return &chunks.InitiatorInitialKeyingChunk{
+		InitiatorSessionID:           in.SessionID,
+		CookieEcho:                   in.cookie,
+		InitiatorCertificate:         cert,
+		SessionKeyInitiatorComponent: in.skic,
+	}
+}
+
+// selects checks that responder is the peer selected by fingerprint if any
+func (in *Initiator) selects(certificate []byte) bool {
+	epd, err := crypto.ParseEpd(in.Epd)
+	if err != nil || epd.Fingerprint == nil {
+		return true
+	}
+
+	cert, err := crypto.ParseCertificate(certificate)
+	if err != nil {
+		return false
+	}
+
+	return epd.Selects(cert)
+}
+
+// HandleResponderHello matches tag echo and replies with initiator keying
+func (in *Initiator) HandleResponderHello(chnk *chunks.ResponderHelloChunk, addr *net.UDPAddr) (Chunk, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if !in.Type.IsValidChunkType(chnk.Type()) {
+		return nil, errors.New("Unexpected responder hello")
+	}
+
+	if !bytes.Equal(chnk.TagEcho, in.Tag) {
+		return nil, errors.New("Responder hello tag echo mismatch")
+	}
+
+	if !in.selects(chnk.ResponderCertificate) {
+		return nil, errors.New("Responder certificate doesn't match endpoint discriminator")
+	}
+
+	in.Type.GotChunkType(chnk.Type())
+
+	in.addr = addr
+	in.cookie = chnk.Cookie
+
+	// Keying is sent right away, retransmission timer restarts
+	in.attempts++
+	in.interval = in.RetransmitInterval
+	in.next = time.Now().Add(in.interval)
+	in.interval *= 2
+
+	return in.keying(), nil
+}
+
+// HandleCookieChange replaces cookie and retries keying
+func (in *Initiator) HandleCookieChange(chnk *chunks.HelloCookieChangeChunk) (Chunk, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if !in.Type.IsValidChunkType(chnk.Type()) {
+		return nil, errors.New("Unexpected hello cookie change")
+	}
+
+	if !bytes.Equal(chnk.OldCookie, in.cookie) {
+		return nil, errors.New("Hello cookie change doesn't match the cookie")
+	}
+
+	in.Type.GotChunkType(chnk.Type())
+	in.cookie = chnk.NewCookie
+
+	in.attempts++
+	in.interval = in.RetransmitInterval
+	in.next = time.Now().Add(in.interval)
+	in.interval *= 2
+
+	return in.keying(), nil
+}
+
+// HandleResponderKeying completes handshake and establishes session
+func (in *Initiator) HandleResponderKeying(chnk *chunks.ResponderInitialKeyingChunk, addr *net.UDPAddr) (*Session, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if !in.Type.IsValidChunkType(chnk.Type()) {
+		return nil, errors.New("Unexpected responder initial keying")
+	}
+
+	if chnk.ResponderSessionID == 0 {
+		return nil, errors.New("Responder session ID is zero")
+	}
+
+	if err := in.profile.FinishKeying(chnk.SessionKeyResponderComponent); err != nil {
+		return nil, err
+	}
+
+	in.Type.GotChunkType(chnk.Type())
+
+	s := NewWith(in.profile, in.Type.NextType())
+	s.ID = in.SessionID
+	s.RemoteID = chnk.ResponderSessionID
+	s.Mode = InitiatorMode
+	s.Established = true
+	s.addr = addr
+	s.ResponderAddr = connection.PeerAddressFrom(addr)
+	s.ResponderAddr.Origin = connection.RemoteOrigin
+
+	in.session = s
+	close(in.done)
+
+	return s, nil
+}
@@ -0,0 +1,209 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package session
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rtmfpew/rtmfpew/protocol/chunks"
+	"github.com/rtmfpew/rtmfpew/protocol/crypto"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestInitiatorHandshake(t *testing.T) {
+	Convey("Given an initiator", t, func() {
+		addr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:1935")
+		epd := []byte("rtmfp://127.0.0.1/app")
+
+		in, err := NewInitiator(addr, epd, 0x1122)
+		So(err, ShouldBeNil)
+		So(len(in.Tag), ShouldEqual, TagLength)
+
+		in.RetransmitInterval = time.Second
+		in.Timeout = 10 * time.Second
+		now := time.Now()
+
+		Convey("It should send initiator hello first", func() {
+			chnk, err := in.Poll(now)
+			So(err, ShouldBeNil)
+
+			hello, ok := chnk.(*chunks.InitiatorHelloChunk)
+			So(ok, ShouldBeTrue)
+			So(hello.Epd, ShouldResemble, epd)
+			So(hello.Tag, ShouldResemble, in.Tag)
+		})
+
+		Convey("It should retransmit hello with backoff", func() {
+			in.Poll(now)
+
+			chnk, _ := in.Poll(now.Add(500 * time.Millisecond))
+			So(chnk, ShouldBeNil)
+
+			chnk, _ = in.Poll(now.Add(time.Second))
+			So(chnk, ShouldNotBeNil)
+
+			chnk, _ = in.Poll(now.Add(2500 * time.Millisecond))
+			So(chnk, ShouldBeNil)
+
+			chnk, _ = in.Poll(now.Add(3 * time.Second))
+			So(chnk, ShouldNotBeNil)
+		})
+
+		Convey("It should time out with typed error", func() {
+			in.Poll(now)
+
+			_, err := in.Poll(now.Add(in.Timeout))
+			So(err, ShouldNotBeNil)
+
+			timeoutErr, ok := err.(*HandshakeTimeoutError)
+			So(ok, ShouldBeTrue)
+			So(timeoutErr.Timeout(), ShouldBeTrue)
+			So(timeoutErr.Attempts, ShouldEqual, 1)
+
+			<-in.Done()
+			s, err := in.Result()
+			So(s, ShouldBeNil)
+			So(err, ShouldEqual, timeoutErr)
+		})
+
+		Convey("It should ignore responder hello with wrong tag", func() {
+			in.Poll(now)
+
+			_, err := in.HandleResponderHello(&chunks.ResponderHelloChunk{
+				TagEcho: []byte{0x01, 0x02},
+				Cookie:  []byte{0x03, 0x04},
+			}, addr)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("It should reject responder not selected by fingerprint", func() {
+			cert, _ := crypto.NewCertificate()
+			ID, _ := cert.PeerID()
+
+			in.Epd, _ = crypto.FingerprintEpd(ID).Bytes()
+			in.Poll(now)
+
+			other, _ := crypto.NewCertificate()
+			otherCert, _ := other.Bytes()
+			_, err := in.HandleResponderHello(&chunks.ResponderHelloChunk{
+				TagEcho:              in.Tag,
+				Cookie:               []byte{0x03, 0x04},
+				ResponderCertificate: otherCert,
+			}, addr)
+			So(err, ShouldNotBeNil)
+
+			certData, _ := cert.Bytes()
+			_, err = in.HandleResponderHello(&chunks.ResponderHelloChunk{
+				TagEcho:              in.Tag,
+				Cookie:               []byte{0x03, 0x04},
+				ResponderCertificate: certData,
+			}, addr)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("It should complete handshake", func() {
+			in.Poll(now)
+
+			cookie := []byte{0x03, 0x04, 0x05}
+			chnk, err := in.HandleResponderHello(&chunks.ResponderHelloChunk{
+				TagEcho: in.Tag,
+				Cookie:  cookie,
+			}, addr)
+			So(err, ShouldBeNil)
+
+			keying, ok := chnk.(*chunks.InitiatorInitialKeyingChunk)
+			So(ok, ShouldBeTrue)
+			So(keying.InitiatorSessionID, ShouldEqual, 0x1122)
+			So(keying.CookieEcho, ShouldResemble, cookie)
+
+			_, err = in.HandleResponderHello(&chunks.ResponderHelloChunk{
+				TagEcho: in.Tag,
+				Cookie:  cookie,
+			}, addr)
+			So(err, ShouldNotBeNil)
+
+			_, err = in.HandleResponderKeying(&chunks.ResponderInitialKeyingChunk{
+				ResponderSessionID:           0x3344,
+				SessionKeyResponderComponent: []byte{0x01},
+			}, addr)
+			So(err, ShouldNotBeNil)
+
+			responder, err := crypto.NewFlashProfile()
+			So(err, ShouldBeNil)
+
+			skrc, err := responder.ResponderComponent(keying.SessionKeyInitiatorComponent)
+			So(err, ShouldBeNil)
+
+			s, err := in.HandleResponderKeying(&chunks.ResponderInitialKeyingChunk{
+				ResponderSessionID:           0x3344,
+				SessionKeyResponderComponent: skrc,
+			}, addr)
+			So(err, ShouldBeNil)
+			So(s.ID, ShouldEqual, 0x1122)
+			So(s.RemoteID, ShouldEqual, 0x3344)
+			So(s.Mode, ShouldEqual, InitiatorMode)
+			So(s.Established, ShouldBeTrue)
+
+			_, ok = s.Type.(*NormalSessionType)
+			So(ok, ShouldBeTrue)
+
+			<-in.Done()
+			result, err := in.Result()
+			So(err, ShouldBeNil)
+			So(result, ShouldEqual, s)
+		})
+
+		Convey("It should retry keying with a changed cookie", func() {
+			in.Poll(now)
+
+			cookie := []byte{0x03, 0x04, 0x05}
+			in.HandleResponderHello(&chunks.ResponderHelloChunk{
+				TagEcho: in.Tag,
+				Cookie:  cookie,
+			}, addr)
+
+			_, err := in.HandleCookieChange(&chunks.HelloCookieChangeChunk{
+				OldCookie: []byte{0x01},
+				NewCookie: []byte{0x02},
+			})
+			So(err, ShouldNotBeNil)
+
+			fresh := []byte{0x06, 0x07, 0x08}
+			chnk, err := in.HandleCookieChange(&chunks.HelloCookieChangeChunk{
+				OldCookie: cookie,
+				NewCookie: fresh,
+			})
+			So(err, ShouldBeNil)
+
+			keying, ok := chnk.(*chunks.InitiatorInitialKeyingChunk)
+			So(ok, ShouldBeTrue)
+			So(keying.CookieEcho, ShouldResemble, fresh)
+
+			responder, _ := crypto.NewFlashProfile()
+			skrc, _ := responder.ResponderComponent(keying.SessionKeyInitiatorComponent)
+
+			_, err = in.HandleResponderKeying(&chunks.ResponderInitialKeyingChunk{
+				ResponderSessionID:           0x3344,
+				SessionKeyResponderComponent: skrc,
+			}, addr)
+			So(err, ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,89 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package session
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rtmfpew/rtmfpew/protocol/chunks"
+)
+
+// SessionTimeoutError is a close reason of the session which far end stopped answering pings
+type SessionTimeoutError struct {
+	Pings int
+}
+
+func (err *SessionTimeoutError) Error() string {
+	return fmt.Sprintf("Session timed out after %d unanswered pings", err.Pings)
+}
+
+// Timeout is always true, makes SessionTimeoutError a net.Error
+func (err *SessionTimeoutError) Timeout() bool {
+	return true
+}
+
+// Temporary is always false, makes SessionTimeoutError a net.Error
+func (err *SessionTimeoutError) Temporary() bool {
+	return false
+}
+
+// SetKeepalive sets how long established session can be idle before it's pinged
+// and after how many unanswered pings it's closed, zero interval disables keepalive
+func (session *Session) SetKeepalive(interval time.Duration, maxPings int) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	session.keepaliveInterval = interval
+	session.maxPings = maxPings
+}
+
+// keepalive pings the far end when nothing was received or sent for
+// keepalive interval, session is closed when pings aren't answered
+func (session *Session) keepalive(now time.Time) {
+	interval := session.keepaliveInterval
+	if !session.Established || interval <= 0 {
+		return
+	}
+
+	if session.lastRecv.IsZero() {
+		session.lastRecv = now // Handshake is the last thing received
+	}
+
+	if !session.lastPing.IsZero() && now.Sub(session.lastPing) < interval {
+		return
+	}
+
+	silent := now.Sub(session.lastRecv) >= interval
+	if !silent && now.Sub(session.lastSent) < interval {
+		return
+	}
+
+	if silent && session.pings >= session.maxPings {
+		session.close(&SessionTimeoutError{Pings: session.pings})
+		return
+	}
+
+	session.outgoing.PushBack(&chunks.PingChunk{})
+	session.pings++
+	session.lastPing = now
+}
+
+// handlePing answers ping echoing the message
+func (session *Session) handlePing(chnk *chunks.PingChunk) {
+	session.outgoing.PushBack(&chunks.PingReplyChunk{MessageEcho: chnk.Message})
+}
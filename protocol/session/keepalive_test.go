@@ -0,0 +1,130 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package session
+
+import (
+	"container/list"
+	"testing"
+	"time"
+
+	"github.com/rtmfpew/rtmfpew/protocol/chunks"
+	"github.com/rtmfpew/rtmfpew/protocol/connection/flow"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSessionKeepalive(t *testing.T) {
+	Convey("Given an established session", t, func() {
+		s := New(&NormalSessionType{})
+		s.Established = true
+		s.SetKeepalive(time.Second, 2)
+
+		now := time.Now()
+		s.lastRecv = now
+		s.lastSent = now
+
+		pings := func() int {
+			n := 0
+			for e := s.outgoing.Front(); e != nil; e = e.Next() {
+				if _, ok := e.Value.(*chunks.PingChunk); ok {
+					n++
+				}
+			}
+
+			return n
+		}
+
+		Convey("Active session shouldn't be pinged", func() {
+			s.keepalive(now.Add(500 * time.Millisecond))
+			So(pings(), ShouldEqual, 0)
+		})
+
+		Convey("Idle session should be pinged once per interval", func() {
+			s.keepalive(now.Add(time.Second))
+			So(pings(), ShouldEqual, 1)
+
+			s.keepalive(now.Add(1500 * time.Millisecond))
+			So(pings(), ShouldEqual, 1)
+
+			s.keepalive(now.Add(2 * time.Second))
+			So(pings(), ShouldEqual, 2)
+		})
+
+		Convey("Quiet session should be pinged to keep NAT binding", func() {
+			s.lastRecv = now.Add(time.Second)
+			s.keepalive(now.Add(time.Second))
+			So(pings(), ShouldEqual, 1)
+		})
+
+		Convey("Session should be closed after unanswered pings", func() {
+			recv := flow.NewReceiveFlow(1)
+			s.recvFlows[1] = recv
+
+			s.keepalive(now.Add(time.Second))
+			s.keepalive(now.Add(2 * time.Second))
+			So(s.Err(), ShouldBeNil)
+
+			s.keepalive(now.Add(3 * time.Second))
+			So(s.Err(), ShouldResemble, &SessionTimeoutError{Pings: 2})
+			So(s.outgoing.Len(), ShouldEqual, 0)
+
+			_, err := recv.ReadMessage()
+			So(err, ShouldEqual, flow.ErrFlowClosed)
+
+			done := false
+			select {
+			case <-s.Done():
+				done = true
+			default:
+			}
+			So(done, ShouldBeTrue)
+
+			packets, err := s.Flush()
+			So(err, ShouldBeNil)
+			So(len(packets), ShouldEqual, 0)
+		})
+
+		Convey("Received packet should answer pings", func() {
+			s.keepalive(now.Add(time.Second))
+			s.keepalive(now.Add(2 * time.Second))
+
+			s.Receive(&Packet{Chunks: list.New()}, nil)
+			So(s.pings, ShouldEqual, 0)
+		})
+	})
+
+	Convey("Given two sessions", t, func() {
+		a := New(&NormalSessionType{})
+		b := New(&NormalSessionType{})
+
+		Convey("Ping should be answered with echo", func() {
+			a.Send(&chunks.PingChunk{Message: []byte{0x01, 0x02}})
+			packets, err := a.Flush()
+			So(err, ShouldBeNil)
+
+			pckt, err := b.ReadPacket(packets[0])
+			So(err, ShouldBeNil)
+			b.Receive(pckt, nil)
+
+			packets, err = b.Flush()
+			So(err, ShouldBeNil)
+
+			pckt, err = a.ReadPacket(packets[0])
+			So(err, ShouldBeNil)
+			So(pckt.Chunks.Front().Value, ShouldResemble, &chunks.PingReplyChunk{MessageEcho: []byte{0x01, 0x02}})
+		})
+	})
+}
@@ -15,3 +15,37 @@
 //
 
 package session
+
+import (
+	"github.com/rtmfpew/rtmfpew/protocol/chunks"
+)
+
+// NormalSessionType validates chunks of the established session
+type NormalSessionType struct{}
+
+// IsValidChunkType checks if chunk is allowed in established session
+func (t *NormalSessionType) IsValidChunkType(typ byte) bool {
+	switch typ {
+	case chunks.PingChunkType,
+		chunks.PingReplyChunkType,
+		chunks.UserDataChunkType,
+		chunks.NextUserDataChunkType,
+		chunks.BufferProbeChunkType,
+		chunks.FlowExceptionReportChunkType,
+		chunks.DataAcknowledgementBitmapChunkType,
+		chunks.DataAcknowledgementRangesChunkType,
+		chunks.SessionCloseRequestChunkType,
+		chunks.SessionCloseAcknowledgementType:
+		return true
+	}
+
+	return false
+}
+
+// GotChunkType does nothing, established session has no states yet
+func (t *NormalSessionType) GotChunkType(typ byte) {}
+
+// NextType returns the same type
+func (t *NormalSessionType) NextType() SessionType {
+	return t
+}
@@ -22,11 +22,12 @@ import (
 	"encoding/binary"
 
 	"github.com/rtmfpew/amfy/vlu"
+	"github.com/rtmfpew/rtmfpew/protocol/crypto"
 )
 
 const (
 	// ForbiddenMode should be ignored
-	ForbiddenMode = 0
+	ForbiddenMode = iota
 	// InitiatorMode used for session handshake
 	InitiatorMode
 	// ResponderMode used for communication
@@ -86,15 +87,19 @@ func (pckt *Packet) writeTo(buffer *bytes.Buffer) error {
 
 	flags = flags | pckt.Mode
 
+	if err := buffer.WriteByte(flags); err != nil {
+		return err
+	}
+
 	pckt.HeaderLength = 1
 	if pckt.TimestampPresent {
 		binary.Write(buffer, binary.BigEndian, pckt.Timestamp)
-		pckt.HeaderLength++
+		pckt.HeaderLength += 2
 	}
 
 	if pckt.TimestampEchoPresent {
 		binary.Write(buffer, binary.BigEndian, pckt.TimestampEcho)
-		pckt.HeaderLength++
+		pckt.HeaderLength += 2
 	}
 
 	return nil
@@ -117,19 +122,19 @@ func (pckt *Packet) readFrom(buffer *bytes.Buffer) error {
 
 	pckt.HeaderLength = 1
 	if pckt.TimestampPresent {
-		if err = binary.Read(buffer, binary.BigEndian, pckt.Timestamp); err != nil {
+		if err = binary.Read(buffer, binary.BigEndian, &pckt.Timestamp); err != nil {
 			return err
 		}
 
-		pckt.HeaderLength++
+		pckt.HeaderLength += 2
 	}
 
 	if pckt.TimestampEchoPresent {
-		if err = binary.Read(buffer, binary.BigEndian, pckt.TimestampEcho); err != nil {
+		if err = binary.Read(buffer, binary.BigEndian, &pckt.TimestampEcho); err != nil {
 			return err
 		}
 
-		pckt.HeaderLength++
+		pckt.HeaderLength += 2
 	}
 
 	return nil
@@ -146,12 +151,11 @@ func (pckt *Packet) writeChunkTo(chnk Chunk, buffer *bytes.Buffer) error {
 	return nil
 }
 
-func (pckt *Packet) writePaddingTo(buffer *bytes.Buffer) error {
-	padding := make([]byte, (pckt.DataLength+pckt.HeaderLength-1)%16)
-
-	for i := uint32(0); i < (pckt.DataLength+pckt.HeaderLength-1)%16; i++ {
-		padding[i] = 0xFF
-	}
+// writePaddingTo pads encrypted part of the packet starting at offset
+// with 0xFF up to the cipher block size
+func (pckt *Packet) writePaddingTo(buffer *bytes.Buffer, offset int) error {
+	length := (crypto.BlockSize - (buffer.Len()-offset)%crypto.BlockSize) % crypto.BlockSize
 
-	return binary.Write(buffer, binary.BigEndian, padding)
+	_, err := buffer.Write(bytes.Repeat([]byte{0xFF}, length))
+	return err
 }
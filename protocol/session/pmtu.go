@@ -0,0 +1,221 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package session
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/rtmfpew/rtmfpew/config"
+	"github.com/rtmfpew/rtmfpew/protocol/chunks"
+)
+
+// mtuSizes are packet sizes probed in order, the largest fits
+// into Ethernet frame with IPv4 and UDP headers
+var mtuSizes = []uint16{1024, 1200, 1280, 1400, 1452, 1472}
+
+// probeMagic starts message of padded ping probing path MTU
+var probeMagic = []byte("PMTU")
+
+const (
+	maxProbeAttempts = 3
+	pmtuLifetime     = 10 * time.Minute // Discovered MTU is probed again after it
+	pmtuLossLimit    = 2                // Retransmission timeouts in a row after which MTU falls back
+)
+
+// mtuCache keeps path MTUs discovered by sessions per destination
+type mtuCache struct {
+	mu      sync.Mutex
+	entries map[string]mtuEntry
+}
+
+type mtuEntry struct {
+	mtu     uint16
+	expires time.Time
+}
+
+var pathMTUs = &mtuCache{entries: make(map[string]mtuEntry)}
+
+func (cache *mtuCache) get(dest string, now time.Time) uint16 {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	entry, ok := cache.entries[dest]
+	if !ok || now.After(entry.expires) {
+		delete(cache.entries, dest)
+		return 0
+	}
+
+	return entry.mtu
+}
+
+func (cache *mtuCache) put(dest string, mtu uint16, now time.Time) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.entries[dest] = mtuEntry{mtu: mtu, expires: now.Add(pmtuLifetime)}
+}
+
+func (cache *mtuCache) remove(dest string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	delete(cache.entries, dest)
+}
+
+// pmtuDiscovery probes path with padded pings of increasing size
+type pmtuDiscovery struct {
+	probing  uint16 // Size of the probe waiting for reply, zero if none
+	sentAt   time.Time
+	attempts int
+	ceiling  uint16 // The smallest size which probe was lost, zero if none
+	nextAt   time.Time
+	losses   int // Retransmission timeouts in a row
+}
+
+// MTU returns the largest packet size used for the far end
+func (session *Session) MTU() int {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	return int(session.mtu)
+}
+
+// setMTU changes packet size, fragments which weren't sent yet are split
+// again when it falls back
+func (session *Session) setMTU(mtu uint16) {
+	session.mtu = mtu
+	session.congestion.SetMSS(session.MSS())
+
+	for _, f := range session.sendFlows {
+		f.SetFragmentSize(session.MSS())
+	}
+}
+
+// discoverMTU returns padded ping packet probing the next larger
+// size or nil when it's not time to probe
+func (session *Session) discoverMTU(now time.Time) (*bytes.Buffer, error) {
+	if !session.Established || session.addr == nil {
+		return nil, nil
+	}
+
+	pmtu := &session.pmtu
+	dest := session.addr.String()
+	if cached := pathMTUs.get(dest, now); cached > session.mtu && (pmtu.ceiling == 0 || cached < pmtu.ceiling) {
+		session.setMTU(cached)
+	}
+
+	if pmtu.probing != 0 {
+		if now.Sub(pmtu.sentAt) < session.rto {
+			return nil, nil
+		}
+
+		if pmtu.attempts++; pmtu.attempts >= maxProbeAttempts { // Probe doesn't fit into the path
+			pmtu.ceiling = pmtu.probing
+			pmtu.probing = 0
+		}
+	}
+
+	if pmtu.probing == 0 {
+		if now.Before(pmtu.nextAt) {
+			return nil, nil
+		}
+
+		pmtu.probing = session.nextMTU()
+		pmtu.attempts = 0
+
+		if pmtu.probing == 0 { // Search is over, it's started again later
+			pmtu.ceiling = 0
+			pmtu.nextAt = now.Add(pmtuLifetime)
+			return nil, nil
+		}
+	}
+
+	pmtu.sentAt = now
+	return session.writeProbe(pmtu.probing, now)
+}
+
+// nextMTU returns the next size to probe or zero
+func (session *Session) nextMTU() uint16 {
+	limit := uint16(config.MaxMtu())
+	for _, size := range mtuSizes {
+		if size > session.mtu && size <= limit && (session.pmtu.ceiling == 0 || size < session.pmtu.ceiling) {
+			return size
+		}
+	}
+
+	return 0
+}
+
+// writeProbe writes packet of at most size bytes padded with ping message
+func (session *Session) writeProbe(size uint16, now time.Time) (*bytes.Buffer, error) {
+	message := make([]byte, int(size)-packetOverhead-3) // Chunk header
+	copy(message, probeMagic)
+
+	pckt := Packet{
+		Mode:   session.Mode,
+		Chunks: list.New(),
+	}
+	session.rtt.stamp(&pckt, now)
+	pckt.Chunks.PushBack(&chunks.PingChunk{Message: message})
+
+	buff := bytes.NewBuffer(make([]byte, 0, size))
+	err := session.writePacket(pckt, buff, size)
+
+	return buff, err
+}
+
+// handlePingReply raises MTU when reply to the probe comes
+func (session *Session) handlePingReply(chnk *chunks.PingReplyChunk) {
+	pmtu := &session.pmtu
+	if pmtu.probing == 0 || !bytes.HasPrefix(chnk.MessageEcho, probeMagic) ||
+		len(chnk.MessageEcho) != int(pmtu.probing)-packetOverhead-3 {
+		return
+	}
+
+	session.setMTU(pmtu.probing)
+	pmtu.probing = 0
+	pmtu.nextAt = time.Time{}
+
+	if session.addr != nil {
+		pathMTUs.put(session.addr.String(), session.mtu, time.Now())
+	}
+}
+
+// mtuLost falls back to the base MTU when packets of discovered size
+// are dropped, path may have changed
+func (session *Session) mtuLost(now time.Time) {
+	base := uint16(packetMtu)
+	if session.mtu <= base {
+		return
+	}
+
+	if session.pmtu.losses++; session.pmtu.losses < pmtuLossLimit {
+		return
+	}
+
+	session.pmtu.ceiling = session.mtu
+	session.pmtu.nextAt = now.Add(pmtuLifetime)
+	session.pmtu.losses = 0
+	session.setMTU(base)
+
+	if session.addr != nil {
+		pathMTUs.remove(session.addr.String())
+	}
+}
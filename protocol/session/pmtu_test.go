@@ -0,0 +1,138 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package session
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rtmfpew/rtmfpew/config"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPathMTUDiscovery(t *testing.T) {
+	Convey("Given two established sessions", t, func() {
+		a := New(&NormalSessionType{})
+		b := New(&NormalSessionType{})
+
+		for i, s := range []*Session{a, b} {
+			s.Established = true
+			s.SetKeepalive(0, 0)
+			s.SetAddr(&net.UDPAddr{IP: net.IPv4(192, 0, 2, byte(i+1)), Port: 1935})
+		}
+
+		Reset(func() {
+			pathMTUs.remove(a.Addr().String())
+			pathMTUs.remove(b.Addr().String())
+		})
+
+		exchange := func(from *Session, to *Session, drop func(packet *bytes.Buffer) bool) {
+			packets, err := from.Flush()
+			So(err, ShouldBeNil)
+
+			for _, packet := range packets {
+				if drop != nil && drop(packet) {
+					continue
+				}
+
+				pckt, err := to.ReadPacket(packet)
+				So(err, ShouldBeNil)
+				to.Receive(pckt, to.Addr())
+			}
+		}
+
+		Convey("MTU should grow with answered probes", func() {
+			So(a.MTU(), ShouldEqual, config.Mtu())
+
+			packets, err := a.Flush()
+			So(err, ShouldBeNil)
+			So(len(packets), ShouldEqual, 1)
+			So(packets[0].Len(), ShouldBeLessThanOrEqualTo, 1024)
+			So(packets[0].Len(), ShouldBeGreaterThan, 1024-16)
+
+			pckt, err := b.ReadPacket(packets[0])
+			So(err, ShouldBeNil)
+			b.Receive(pckt, b.Addr())
+
+			exchange(b, a, nil)
+			So(a.MTU(), ShouldEqual, 1024)
+			So(pathMTUs.get(a.Addr().String(), time.Now()), ShouldEqual, 1024)
+			So(b.MTU(), ShouldEqual, config.Mtu())
+
+			Convey("And new fragments should be sized by it", func() {
+				f := a.OpenFlow(nil)
+				f.Write(make([]byte, 1900))
+				So(f.Pending(), ShouldEqual, 2)
+			})
+
+			Convey("And cached MTU should be used by the new session", func() {
+				c := New(&NormalSessionType{})
+				c.Established = true
+				c.SetAddr(a.Addr())
+				c.Flush()
+				So(c.MTU(), ShouldEqual, 1024)
+			})
+		})
+
+		Convey("Lost probes should limit discovery", func() {
+			large := func(packet *bytes.Buffer) bool { return packet.Len() > 1100 }
+
+			for i := 0; i < 8; i++ {
+				a.rto = 0
+				exchange(a, b, large)
+				exchange(b, a, nil)
+			}
+
+			So(a.MTU(), ShouldEqual, 1024)
+			So(a.pmtu.probing, ShouldEqual, 0)
+			So(a.pmtu.nextAt, ShouldHappenAfter, time.Now())
+		})
+
+		Convey("MTU should fall back on loss", func() {
+			a.setMTU(1472)
+			a.mtuLost(time.Now())
+			So(a.MTU(), ShouldEqual, 1472)
+
+			a.mtuLost(time.Now())
+			So(a.MTU(), ShouldEqual, config.Mtu())
+			So(a.pmtu.ceiling, ShouldEqual, 1472)
+		})
+
+		Convey("Fallback should split fragments which weren't sent yet", func() {
+			a.setMTU(1472)
+			So(a.congestion.(*DefaultCongestionController).mss, ShouldEqual, a.MSS())
+
+			f := a.OpenFlow(nil)
+			f.Write(make([]byte, 2*a.MSS()))
+			So(f.Pending(), ShouldEqual, 2)
+
+			a.mtuLost(time.Now())
+			a.mtuLost(time.Now())
+			So(f.Pending(), ShouldBeGreaterThan, 2)
+			So(a.congestion.(*DefaultCongestionController).mss, ShouldEqual, a.MSS())
+
+			packets, err := a.Flush()
+			So(err, ShouldBeNil)
+
+			for _, packet := range packets {
+				So(packet.Len(), ShouldBeLessThanOrEqualTo, config.Mtu())
+			}
+		})
+	})
+}
@@ -0,0 +1,186 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package session
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rtmfpew/rtmfpew/protocol/chunks"
+	"github.com/rtmfpew/rtmfpew/protocol/connection"
+	"github.com/rtmfpew/rtmfpew/protocol/crypto"
+)
+
+// keyedSession is a session established by responder, it's kept
+// for cookie lifetime to answer initiator keying retransmissions
+type keyedSession struct {
+	session *Session
+	keying  *chunks.ResponderInitialKeyingChunk
+	expires time.Time
+}
+
+// Responder drives the responder side of the four-way handshake.
+// No state is kept until initiator echoes a valid cookie.
+type Responder struct {
+	Jar         *CookieJar
+	Certificate *crypto.Certificate
+
+	mu    sync.Mutex
+	keyed map[string]*keyedSession
+}
+
+// NewResponder creates responder with a fresh cookie jar
+func NewResponder() (*Responder, error) {
+	jar, err := NewCookieJar()
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := crypto.NewCertificate()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Responder{
+		Jar:         jar,
+		Certificate: cert,
+		keyed:       make(map[string]*keyedSession),
+	}
+
+	return r, nil
+}
+
+// Poll rotates cookie secret and forgets expired sessions
+func (r *Responder) Poll(now time.Time) error {
+	r.mu.Lock()
+	for cookie, keyed := range r.keyed {
+		if now.After(keyed.expires) {
+			delete(r.keyed, cookie)
+		}
+	}
+	r.mu.Unlock()
+
+	return r.Jar.Poll(now)
+}
+
+// HandleInitiatorHello answers hello with a cookie bound to initiator address and tag.
+// Nil is returned when endpoint discriminator selects another peer.
+func (r *Responder) HandleInitiatorHello(chnk *chunks.InitiatorHelloChunk, addr *net.UDPAddr) *chunks.ResponderHelloChunk {
+	if epd, err := crypto.ParseEpd(chnk.Epd); err == nil && !epd.Selects(r.Certificate) {
+		return nil
+	}
+
+	cert, err := r.Certificate.Bytes()
+	if err != nil {
+		return nil
+	}
+
+	return &chunks.ResponderHelloChunk{
+		TagEcho:              chnk.Tag,
+		Cookie:               r.Jar.Mint(addr, chnk.Tag, time.Now()),
+		ResponderCertificate: cert,
+	}
+}
+
+// HandleInitiatorKeying verifies echoed cookie and creates a session.
+// Session ID is left for the caller to assign, fresh is false
+// when it's a retransmission of already handled keying.
+func (r *Responder) HandleInitiatorKeying(chnk *chunks.InitiatorInitialKeyingChunk, addr *net.UDPAddr) (s *Session, fresh bool, err error) {
+	now := time.Now()
+
+	if _, err = r.Jar.Verify(chnk.CookieEcho, addr, now); err != nil {
+		return nil, false, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if keyed := r.keyed[string(chnk.CookieEcho)]; keyed != nil {
+		return keyed.session, false, nil
+	}
+
+	profile, err := crypto.NewFlashProfile()
+	if err != nil {
+		return nil, false, err
+	}
+
+	skrc, err := profile.ResponderComponent(chnk.SessionKeyInitiatorComponent)
+	if err != nil {
+		return nil, false, err
+	}
+
+	s = NewWith(profile, &NormalSessionType{})
+	s.RemoteID = chnk.InitiatorSessionID
+	s.Mode = ResponderMode
+	s.Established = true
+	s.addr = addr
+	s.InitiatorAddr = connection.PeerAddressFrom(addr)
+	s.InitiatorAddr.Origin = connection.RemoteOrigin
+
+	r.keyed[string(chnk.CookieEcho)] = &keyedSession{
+		session: s,
+		keying: &chunks.ResponderInitialKeyingChunk{
+			SessionKeyResponderComponent: skrc,
+		},
+		expires: now.Add(r.Jar.Lifetime),
+	}
+
+	return s, true, nil
+}
+
+// ChangeCookie creates hello cookie change for the initiator which address has changed since hello
+func (r *Responder) ChangeCookie(chnk *chunks.InitiatorInitialKeyingChunk, addr *net.UDPAddr) (*chunks.HelloCookieChangeChunk, error) {
+	cookie, err := r.Jar.Remint(chnk.CookieEcho, addr, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := r.Certificate.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	return chnk.ChangeCookie(&chunks.ResponderHelloChunk{
+		Cookie:               cookie,
+		ResponderCertificate: cert,
+	})
+}
+
+// Forget drops session keyed with cookie when it can't be established,
+// retransmitted keying creates a new one
+func (r *Responder) Forget(cookie []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.keyed, string(cookie))
+}
+
+// Keying returns responder keying for the session established with cookie
+func (r *Responder) Keying(cookie []byte) *chunks.ResponderInitialKeyingChunk {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	keyed := r.keyed[string(cookie)]
+	if keyed == nil || keyed.session.ID == 0 {
+		return nil
+	}
+
+	keyed.keying.ResponderSessionID = keyed.session.ID
+
+	return keyed.keying
+}
@@ -0,0 +1,144 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package session
+
+import (
+	"net"
+	"testing"
+
+	"github.com/rtmfpew/rtmfpew/protocol/chunks"
+	"github.com/rtmfpew/rtmfpew/protocol/crypto"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestResponderHandshake(t *testing.T) {
+	Convey("Given a responder and an initiator hello", t, func() {
+		r, err := NewResponder()
+		So(err, ShouldBeNil)
+
+		addr, _ := net.ResolveUDPAddr("udp", "53.13.1.45:1935")
+		hello := chunks.InitiatorHelloChunkSample()
+
+		rhello := r.HandleInitiatorHello(hello, addr)
+
+		initiator, err := crypto.NewFlashProfile()
+		So(err, ShouldBeNil)
+
+		skic, err := initiator.InitiatorComponent()
+		So(err, ShouldBeNil)
+
+		Convey("It should answer with tag echo and cookie", func() {
+			So(rhello.TagEcho, ShouldResemble, hello.Tag)
+			So(len(rhello.Cookie), ShouldBeGreaterThan, 0)
+			So(len(r.keyed), ShouldEqual, 0)
+		})
+
+		Convey("It should only answer hello selecting its certificate", func() {
+			ID, _ := r.Certificate.PeerID()
+			hello.Epd, _ = crypto.FingerprintEpd(ID).Bytes()
+			So(r.HandleInitiatorHello(hello, addr), ShouldNotBeNil)
+
+			other, _ := crypto.NewCertificate()
+			otherID, _ := other.PeerID()
+			hello.Epd, _ = crypto.FingerprintEpd(otherID).Bytes()
+			So(r.HandleInitiatorHello(hello, addr), ShouldBeNil)
+		})
+
+		Convey("It should reject keying with a forged cookie", func() {
+			keying := &chunks.InitiatorInitialKeyingChunk{
+				InitiatorSessionID: 0x1122,
+				CookieEcho:         []byte{0x01, 0x02, 0x03},
+			}
+
+			s, _, err := r.HandleInitiatorKeying(keying, addr)
+			So(err, ShouldNotBeNil)
+			So(s, ShouldBeNil)
+			So(len(r.keyed), ShouldEqual, 0)
+		})
+
+		Convey("It should establish session on a valid cookie once", func() {
+			keying := &chunks.InitiatorInitialKeyingChunk{
+				InitiatorSessionID:           0x1122,
+				CookieEcho:                   rhello.Cookie,
+				SessionKeyInitiatorComponent: skic,
+			}
+
+			s, fresh, err := r.HandleInitiatorKeying(keying, addr)
+			So(err, ShouldBeNil)
+			So(fresh, ShouldBeTrue)
+			So(s.RemoteID, ShouldEqual, 0x1122)
+			So(s.Mode, ShouldEqual, ResponderMode)
+			So(r.Keying(rhello.Cookie), ShouldBeNil)
+
+			err = initiator.FinishKeying(r.keyed[string(rhello.Cookie)].keying.SessionKeyResponderComponent)
+			So(err, ShouldBeNil)
+
+			s.ID = 0x3344
+			rkeying := r.Keying(rhello.Cookie)
+			So(rkeying, ShouldNotBeNil)
+			So(rkeying.ResponderSessionID, ShouldEqual, 0x3344)
+
+			again, fresh, err := r.HandleInitiatorKeying(keying, addr)
+			So(err, ShouldBeNil)
+			So(fresh, ShouldBeFalse)
+			So(again, ShouldEqual, s)
+		})
+
+		Convey("It should key session again after it's forgotten", func() {
+			keying := &chunks.InitiatorInitialKeyingChunk{
+				InitiatorSessionID:           0x1122,
+				CookieEcho:                   rhello.Cookie,
+				SessionKeyInitiatorComponent: skic,
+			}
+
+			s, _, err := r.HandleInitiatorKeying(keying, addr)
+			So(err, ShouldBeNil)
+
+			r.Forget(rhello.Cookie)
+			So(len(r.keyed), ShouldEqual, 0)
+
+			again, fresh, err := r.HandleInitiatorKeying(keying, addr)
+			So(err, ShouldBeNil)
+			So(fresh, ShouldBeTrue)
+			So(again, ShouldNotEqual, s)
+		})
+
+		Convey("It should change cookie when initiator address changes", func() {
+			keying := &chunks.InitiatorInitialKeyingChunk{
+				InitiatorSessionID:           0x1122,
+				CookieEcho:                   rhello.Cookie,
+				SessionKeyInitiatorComponent: skic,
+			}
+
+			moved, _ := net.ResolveUDPAddr("udp", "53.13.1.45:2935")
+
+			_, _, err := r.HandleInitiatorKeying(keying, moved)
+			So(err, ShouldEqual, ErrCookieAddressChanged)
+
+			change, err := r.ChangeCookie(keying, moved)
+			So(err, ShouldBeNil)
+			So(change.OldCookie, ShouldResemble, rhello.Cookie)
+
+			keying.CookieEcho = change.NewCookie
+			s, fresh, err := r.HandleInitiatorKeying(keying, moved)
+			So(err, ShouldBeNil)
+			So(fresh, ShouldBeTrue)
+			So(s.Addr(), ShouldEqual, moved)
+		})
+	})
+}
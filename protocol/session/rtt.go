@@ -0,0 +1,165 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package session
+
+import (
+	"time"
+
+	"github.com/rtmfpew/rtmfpew/config"
+)
+
+// TimestampResolution is a tick of the packet timestamp clock
+const TimestampResolution = 4 * time.Millisecond
+
+// maxEchoAge is how long received timestamp can be echoed, it's a half of the clock period
+const maxEchoAge = 32768 * TimestampResolution
+
+// Stats contains session transport statistics
+type Stats struct {
+	RTT               time.Duration // The last round trip time sample
+	SmoothedRTT       time.Duration
+	RTTVariance       time.Duration
+	RetransmitTimeout time.Duration
+	CongestionWindow  int
+}
+
+// rttEstimator keeps timestamps state and smoothed round trip time of the session
+type rttEstimator struct {
+	epoch time.Time // Start of the timestamp clock
+
+	tsRx     uint16    // The last timestamp received from the far end
+	tsRxTime time.Time // When it was received, zero if nothing to echo
+	tsEcho   uint16    // The last echo sent
+	echoed   bool
+
+	tsEchoRx uint16 // The last echo received
+	echoRx   bool
+
+	measured bool
+	rtt      time.Duration
+	srtt     time.Duration
+	rttvar   time.Duration
+}
+
+// timestamp returns the clock value at now
+func (est *rttEstimator) timestamp(now time.Time) uint16 {
+	return uint16(now.Sub(est.epoch) / TimestampResolution)
+}
+
+// stamp sets timestamp of outgoing packet and echoes received one
+// adjusted by time it was held
+func (est *rttEstimator) stamp(pckt *Packet, now time.Time) {
+	pckt.Timestamp = est.timestamp(now)
+	pckt.TimestampPresent = true
+
+	if est.tsRxTime.IsZero() {
+		return
+	}
+
+	held := now.Sub(est.tsRxTime)
+	if held >= maxEchoAge {
+		est.tsRxTime = time.Time{}
+		return
+	}
+
+	echo := est.tsRx + uint16(held/TimestampResolution)
+	if est.echoed && echo == est.tsEcho {
+		return
+	}
+
+	pckt.TimestampEcho = echo
+	pckt.TimestampEchoPresent = true
+	est.tsEcho = echo
+	est.echoed = true
+}
+
+// received takes timestamps of incoming packet
+func (est *rttEstimator) received(pckt *Packet, now time.Time) {
+	if pckt.TimestampPresent {
+		est.tsRx = pckt.Timestamp
+		est.tsRxTime = now
+	}
+
+	if !pckt.TimestampEchoPresent {
+		return
+	}
+
+	if est.echoRx && pckt.TimestampEcho-est.tsEchoRx >= 32768 {
+		return // Stale or reordered echo
+	}
+
+	est.tsEchoRx = pckt.TimestampEcho
+	est.echoRx = true
+
+	elapsed := est.timestamp(now) - pckt.TimestampEcho
+	if elapsed >= 32768 {
+		return // Echo from the future
+	}
+
+	est.sample(time.Duration(elapsed) * TimestampResolution)
+}
+
+// sample updates smoothed round trip time as RFC 6298 does
+func (est *rttEstimator) sample(rtt time.Duration) {
+	if !est.measured {
+		est.srtt = rtt
+		est.rttvar = rtt / 2
+		est.measured = true
+	} else {
+		delta := est.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+
+		est.rttvar = (3*est.rttvar + delta) / 4
+		est.srtt = (7*est.srtt + rtt) / 8
+	}
+
+	est.rtt = rtt
+}
+
+// timeout returns retransmission timeout, the initial one is used until the first sample
+func (est *rttEstimator) timeout() time.Duration {
+	if !est.measured {
+		return config.RetransmitTimeout()
+	}
+
+	rto := est.srtt + 4*est.rttvar + config.DelayedAckTimeout()
+	if limit := config.MinRetransmitTimeout(); rto < limit {
+		rto = limit
+	}
+
+	if limit := config.MaxRetransmitTimeout(); rto > limit {
+		rto = limit
+	}
+
+	return rto
+}
+
+// Stats returns current transport statistics
+func (session *Session) Stats() Stats {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	return Stats{
+		RTT:               session.rtt.rtt,
+		SmoothedRTT:       session.rtt.srtt,
+		RTTVariance:       session.rtt.rttvar,
+		RetransmitTimeout: session.rto,
+		CongestionWindow:  session.congestion.Window(),
+	}
+}
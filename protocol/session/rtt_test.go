@@ -0,0 +1,122 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package session
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rtmfpew/rtmfpew/config"
+	"github.com/rtmfpew/rtmfpew/protocol/chunks"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRTTEstimation(t *testing.T) {
+	Convey("Given round trip time estimator", t, func() {
+		epoch := time.Now()
+		est := &rttEstimator{epoch: epoch}
+
+		Convey("Outgoing packet should be stamped with 4ms clock", func() {
+			pckt := &Packet{}
+			est.stamp(pckt, epoch.Add(41*time.Millisecond))
+
+			So(pckt.TimestampPresent, ShouldBeTrue)
+			So(pckt.Timestamp, ShouldEqual, 10)
+			So(pckt.TimestampEchoPresent, ShouldBeFalse)
+		})
+
+		Convey("Received timestamp should be echoed once with held time added", func() {
+			est.received(&Packet{TimestampPresent: true, Timestamp: 100}, epoch)
+
+			pckt := &Packet{}
+			est.stamp(pckt, epoch.Add(20*time.Millisecond))
+			So(pckt.TimestampEchoPresent, ShouldBeTrue)
+			So(pckt.TimestampEcho, ShouldEqual, 105)
+
+			pckt = &Packet{}
+			est.stamp(pckt, epoch.Add(21*time.Millisecond))
+			So(pckt.TimestampEchoPresent, ShouldBeFalse)
+		})
+
+		Convey("Echo should be wrapped around the clock", func() {
+			est.received(&Packet{TimestampPresent: true, Timestamp: 0xFFFF}, epoch)
+
+			pckt := &Packet{}
+			est.stamp(pckt, epoch.Add(8*time.Millisecond))
+			So(pckt.TimestampEcho, ShouldEqual, 1)
+		})
+
+		Convey("Timestamp shouldn't be echoed for too long", func() {
+			est.received(&Packet{TimestampPresent: true, Timestamp: 1}, epoch)
+
+			pckt := &Packet{}
+			est.stamp(pckt, epoch.Add(maxEchoAge))
+			So(pckt.TimestampEchoPresent, ShouldBeFalse)
+		})
+
+		Convey("Echo should give smoothed round trip time", func() {
+			So(est.timeout(), ShouldEqual, config.RetransmitTimeout())
+
+			now := epoch.Add(time.Second)
+			est.received(&Packet{TimestampEchoPresent: true, TimestampEcho: est.timestamp(now) - 25}, now)
+			So(est.rtt, ShouldEqual, 100*time.Millisecond)
+			So(est.srtt, ShouldEqual, 100*time.Millisecond)
+			So(est.rttvar, ShouldEqual, 50*time.Millisecond)
+			So(est.timeout(), ShouldEqual, 500*time.Millisecond)
+
+			now = now.Add(time.Second)
+			est.received(&Packet{TimestampEchoPresent: true, TimestampEcho: est.timestamp(now) - 50}, now)
+			So(est.rtt, ShouldEqual, 200*time.Millisecond)
+			So(est.srtt, ShouldEqual, 112500*time.Microsecond)
+			So(est.rttvar, ShouldEqual, 62500*time.Microsecond)
+
+			Convey("And stale echo should be ignored", func() {
+				est.received(&Packet{TimestampEchoPresent: true, TimestampEcho: est.timestamp(now) - 100}, now)
+				So(est.rtt, ShouldEqual, 200*time.Millisecond)
+			})
+		})
+	})
+
+	Convey("Given two sessions", t, func() {
+		a := New(&NormalSessionType{})
+		b := New(&NormalSessionType{})
+
+		exchange := func(from *Session, to *Session) {
+			from.Send(&chunks.PingChunk{Message: []byte{0x01}})
+			packets, err := from.Flush()
+			So(err, ShouldBeNil)
+
+			for _, packet := range packets {
+				pckt, err := to.ReadPacket(packet)
+				So(err, ShouldBeNil)
+				So(pckt.TimestampPresent, ShouldBeTrue)
+				to.Receive(pckt, nil)
+			}
+		}
+
+		Convey("Round trip should be measured by both of them", func() {
+			exchange(a, b)
+			exchange(b, a)
+			exchange(a, b)
+
+			So(a.rtt.measured, ShouldBeTrue)
+			So(b.rtt.measured, ShouldBeTrue)
+			So(a.Stats().SmoothedRTT, ShouldBeLessThan, time.Second)
+			So(a.Stats().CongestionWindow, ShouldEqual, a.congestion.Window())
+		})
+	})
+}
@@ -0,0 +1,134 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package session
+
+import (
+	"sort"
+
+	"github.com/rtmfpew/amfy/vlu"
+	"github.com/rtmfpew/rtmfpew/protocol/chunks"
+	"github.com/rtmfpew/rtmfpew/protocol/connection/flow"
+)
+
+// scheduler decides which flow sends the next fragment.
+// Time critical flows go first, then flows in order of priority.
+// Flows of the same priority are served by smooth weighted round robin.
+type scheduler struct {
+	current map[vlu.Vlu]int // Accumulated weights of the flows
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		current: make(map[vlu.Vlu]int),
+	}
+}
+
+// schedClass is a set of flows served in the round robin
+type schedClass struct {
+	timeCritical bool
+	priority     flow.Priority
+	flows        []*flow.SendFlow
+}
+
+// classes groups flows with pending fragments from the highest class to the lowest
+func (sched *scheduler) classes(flows map[vlu.Vlu]*flow.SendFlow) []*schedClass {
+	classes := make([]*schedClass, 0)
+
+	IDs := make([]vlu.Vlu, 0, len(flows))
+	for ID, f := range flows {
+		if f.Pending() > 0 {
+			IDs = append(IDs, ID)
+		} else {
+			delete(sched.current, ID)
+		}
+	}
+
+	sort.Slice(IDs, func(i, j int) bool { return IDs[i] < IDs[j] })
+
+	for _, ID := range IDs {
+		f := flows[ID]
+		timeCritical, priority := f.TimeCritical(), f.Priority()
+
+		var class *schedClass
+		for _, c := range classes {
+			if c.timeCritical == timeCritical && c.priority == priority {
+				class = c
+				break
+			}
+		}
+
+		if class == nil {
+			class = &schedClass{timeCritical: timeCritical, priority: priority}
+			classes = append(classes, class)
+		}
+
+		class.flows = append(class.flows, f)
+	}
+
+	sort.SliceStable(classes, func(i, j int) bool {
+		if classes[i].timeCritical != classes[j].timeCritical {
+			return classes[i].timeCritical
+		}
+
+		return classes[i].priority > classes[j].priority
+	})
+
+	return classes
+}
+
+// schedule returns fragments of the flows in the order they should be sent
+// until budget bytes of user data are taken or flows run out of fragments
+func (sched *scheduler) schedule(flows map[vlu.Vlu]*flow.SendFlow, budget int) []*chunks.UserDataChunk {
+	scheduled := make([]*chunks.UserDataChunk, 0)
+
+	for _, class := range sched.classes(flows) {
+		active := class.flows
+
+		for budget > 0 && len(active) > 0 {
+			total := 0
+			picked := 0
+			for i, f := range active {
+				weight := f.Weight()
+				total += weight
+				sched.current[f.ID()] += weight
+
+				if sched.current[f.ID()] > sched.current[active[picked].ID()] {
+					picked = i
+				}
+			}
+
+			f := active[picked]
+			sched.current[f.ID()] -= total
+
+			chnk := f.NextChunk()
+			if chnk == nil {
+				delete(sched.current, f.ID())
+				active = append(active[:picked], active[picked+1:]...)
+				continue
+			}
+
+			scheduled = append(scheduled, chnk)
+			budget -= len(chnk.UserData)
+		}
+
+		if budget <= 0 {
+			break
+		}
+	}
+
+	return scheduled
+}
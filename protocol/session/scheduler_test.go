@@ -0,0 +1,85 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package session
+
+import (
+	"testing"
+
+	"github.com/rtmfpew/amfy/vlu"
+	"github.com/rtmfpew/rtmfpew/protocol/connection/flow"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestScheduler(t *testing.T) {
+	Convey("Given scheduler and flows with pending fragments", t, func() {
+		sched := newScheduler()
+		flows := make(map[vlu.Vlu]*flow.SendFlow)
+
+		open := func(ID vlu.Vlu, fragments int) *flow.SendFlow {
+			f := flow.NewSendFlow(ID, 10)
+			for i := 0; i < fragments; i++ {
+				f.Write(make([]byte, 10))
+			}
+
+			flows[ID] = f
+			return f
+		}
+
+		order := func(budget int) []vlu.Vlu {
+			IDs := make([]vlu.Vlu, 0)
+			for _, chnk := range sched.schedule(flows, budget) {
+				IDs = append(IDs, chnk.FlowID)
+			}
+
+			return IDs
+		}
+
+		Convey("Flows of the higher priority should be sent first", func() {
+			open(1, 2).SetPriority(flow.PriorityBulk)
+			open(2, 2).SetPriority(flow.PriorityFlash)
+			open(3, 2)
+
+			So(order(1000), ShouldResemble, []vlu.Vlu{2, 2, 3, 3, 1, 1})
+		})
+
+		Convey("Time critical flows should preempt any priority", func() {
+			open(1, 1).SetPriority(flow.PriorityFlashOverride)
+			open(2, 1).SetTimeCritical(true)
+
+			So(order(1000), ShouldResemble, []vlu.Vlu{2, 1})
+		})
+
+		Convey("Flows of the same priority should share by weight", func() {
+			open(1, 8).SetWeight(3)
+			open(2, 8)
+
+			So(order(30), ShouldResemble, []vlu.Vlu{1, 1, 2})
+
+			Convey("And round robin should continue with the next schedule", func() {
+				So(order(50), ShouldResemble, []vlu.Vlu{1, 1, 1, 2, 1})
+			})
+		})
+
+		Convey("Budget should limit scheduled user data", func() {
+			open(1, 4)
+			open(2, 4)
+
+			So(len(order(25)), ShouldEqual, 3)
+			So(flows[1].Pending()+flows[2].Pending(), ShouldEqual, 5)
+		})
+	})
+}
@@ -17,18 +17,20 @@
 package session
 
 import (
-	"bufio"
 	"bytes"
 	"container/list"
 	"encoding/binary"
 	"errors"
-	"sync/atomic"
+	"io"
+	"net"
+	"sync"
+	"time"
 
 	"github.com/rtmfpew/rtmfpew/config"
 	"github.com/rtmfpew/rtmfpew/protocol/chunks"
 	"github.com/rtmfpew/rtmfpew/protocol/connection"
+	"github.com/rtmfpew/rtmfpew/protocol/connection/flow"
 	"github.com/rtmfpew/rtmfpew/protocol/crypto"
-	"github.com/rtmfpew/rtmfpew/protocol/ip"
 
 	"github.com/rtmfpew/amfy/vlu"
 )
@@ -38,47 +40,106 @@ var (
 	maxFragmentationGap = config.MaxFragmentationGap()
 	maxFragments        = config.MaxFragments()
 	maxFragmentsSize    = config.MaxFragmentsSize()
+	reassemblyTimeout   = config.ReassemblyTimeout()
 )
 
 // SessionType stores current session state and validates it's changes
 type SessionType interface {
-	IsValidChunkType() uint8
-	GotChunkType(uint8)
-	NextType() *SessionType
+	IsValidChunkType(typ byte) bool
+	GotChunkType(typ byte)
+	NextType() SessionType
 }
 
+// packetOverhead is the worst case size of everything but chunks in a packet:
+// scrambled ID, checksum, flags, timestamps and padding
+const packetOverhead = 4 + 2 + 1 + 2 + 2 + 15
+
 // Session stores current connection state
 type Session struct {
-	ID uint32
+	ID       uint32 // Near end session ID, packets are demultiplexed by it
+	RemoteID uint32 // Far end session ID, written into outgoing packets
+
+	Mode byte // Packet mode of outgoing packets
 
 	InitiatorAddr *connection.PeerAddress
 	ResponderAddr *connection.PeerAddress
 
 	profile crypto.Profile
 
-	pcktCounter uint32
-	mtu         uint16
+	mtu uint16
 
 	HasChecksums bool
 	Established  bool
 
-	fragments     map[vlu.Vlu]*list.List
-	fragmentSizes map[vlu.Vlu]uint16
+	fragments map[vlu.Vlu]*reassembly // Incomplete fragmented packets by packet ID
 
 	Type SessionType
+
+	mu       sync.Mutex
+	addr     *net.UDPAddr
+	lastRecv time.Time
+	outgoing *list.List
+
+	nextFlowID vlu.Vlu
+	sendFlows  map[vlu.Vlu]*flow.SendFlow
+	recvFlows  map[vlu.Vlu]*flow.ReceiveFlow
+	lingering  map[vlu.Vlu]time.Time // Finished receive flows are forgotten then
+
+	ackPackets  int       // Packets with user data since the last acknowledgement
+	ackDeadline time.Time // Delayed acknowledgement should be sent by then
+
+	rto        time.Duration // Effective retransmission timeout
+	rtt        rttEstimator
+	pmtu       pmtuDiscovery
+	congestion CongestionController
+	scheduler  *scheduler
+
+	acceptor FlowAcceptor
+	accepted []*acceptedFlow // New flows to be passed to the acceptor
+
+	keepaliveInterval time.Duration
+	maxPings          int
+	lastSent          time.Time
+	lastPing          time.Time
+	pings             int // Pings sent since the last received packet
+
+	state                int
+	closeErr             error
+	closeDeadline        time.Time
+	closeRequestAt       time.Time // When to send the next close request
+	closeRequestInterval time.Duration
+	done                 chan struct{}
+
+	tcSent time.Time // The last time critical user data was sent
+	tcRecv time.Time // The last time critical packet was received by the other sessions of the host
 }
 
 // NewWith creates new session with custom profile
 func NewWith(profile crypto.Profile, t SessionType) *Session {
 	session := &Session{
 		profile:      profile,
-		pcktCounter:  0,
 		mtu:          uint16(packetMtu),
-		HasChecksums: false,
+		HasChecksums: hasChecksums(profile),
 		Established:  false,
+		Mode:         StartupMode,
 		Type:         t,
+		outgoing:     list.New(),
+		fragments:    make(map[vlu.Vlu]*reassembly),
+		nextFlowID:   1,
+		sendFlows:    make(map[vlu.Vlu]*flow.SendFlow),
+		recvFlows:    make(map[vlu.Vlu]*flow.ReceiveFlow),
+		lingering:    make(map[vlu.Vlu]time.Time),
+		rto:          config.RetransmitTimeout(),
+		rtt:          rttEstimator{epoch: time.Now()},
+		scheduler:    newScheduler(),
+
+		keepaliveInterval: config.KeepaliveInterval(),
+		maxPings:          config.MaxUnansweredPings(),
+		done:              make(chan struct{}),
 	}
 
+	session.congestion = NewDefaultCongestionController(session.MSS())
+
 	return session
 }
 
@@ -90,6 +151,21 @@ func New(t SessionType) *Session {
 	return NewWith(profile, t)
 }
 
+// NewStartup creates session reading and writing startup packets the way
+// Flash Player does, with default key and packet checksums
+func NewStartup() *Session {
+	profile := &crypto.FlashProfile{}
+	profile.InitDefault()
+
+	return NewWith(profile, nil)
+}
+
+// hasChecksums tells if packets encrypted with the profile carry checksums
+func hasChecksums(profile crypto.Profile) bool {
+	_, ok := profile.(*crypto.FlashProfile)
+	return ok
+}
+
 // SetEncryptionKey for data cipher
 func (session *Session) SetEncryptionKey(key []byte) error {
 	return session.profile.Init(key)
@@ -100,124 +176,278 @@ func (session *Session) encryptBuffer(buff *bytes.Buffer) error {
 }
 
 func (session *Session) decryptBuffer(buff *bytes.Buffer) error {
-	return session.profile.DecryptAt(buff, 4) // ID size
+	return session.profile.DecryptAt(buff, 0) // ID is already read
+}
+
+// ReadID unscrambles session ID of the raw packet.
+// Scrambled ID is XORed with the first two 32-bit words of the encrypted packet part.
+func ReadID(data []byte) (uint32, error) {
+	if len(data) < 12 {
+		return 0, errors.New("Packet is too short")
+	}
+
+	return binary.BigEndian.Uint32(data[0:4]) ^
+		binary.BigEndian.Uint32(data[4:8]) ^
+		binary.BigEndian.Uint32(data[8:12]), nil
 }
 
 // readID reads session ID
-func (session *Session) readID(buff *bytes.Buffer) error {
-	err := binary.Read(buff, binary.BigEndian, &session.ID)
+func (session *Session) readID(buff *bytes.Buffer) (uint32, error) {
+	ID, err := ReadID(buff.Bytes())
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	peeker := bufio.NewReader(buff)
-	b, err := peeker.Peek(2) // Unscramble session ID
-	session.ID = session.ID ^ uint32(b[0]) ^ uint32(b[1])
+	buff.Next(4)
 
-	return nil
+	return ID, nil
 }
 
-// writeID writes session ID
+// writeID scrambles far end session ID into the encrypted packet
 func (session *Session) writeID(buff *bytes.Buffer) error {
-	buff = bytes.NewBuffer(buff.Bytes()) // resets internal state
-	peeker := bufio.NewReader(buff)
-	b, err := peeker.Peek(2)
-	if err != nil {
-		return err
+	data := buff.Bytes()
+	if len(data) < 12 {
+		return errors.New("Packet is too short")
 	}
 
-	ID := session.ID ^ uint32(b[0]) ^ uint32(b[1])
+	ID := session.RemoteID ^
+		binary.BigEndian.Uint32(data[4:8]) ^
+		binary.BigEndian.Uint32(data[8:12])
 
-	if err = binary.Write(buff, binary.BigEndian, &ID); err != nil {
-		return nil
-	}
+	binary.BigEndian.PutUint32(data[0:4], ID)
 
 	return nil
 }
 
-func (session *Session) fragmentChunks(chnks *list.List) *list.List {
-	fragmentSlice := make([]byte, session.mtu)
-	fragmentBuff := bytes.NewBuffer(fragmentSlice)
+// Addr returns far end address of the session
+func (session *Session) Addr() *net.UDPAddr {
+	session.mu.Lock()
+	defer session.mu.Unlock()
 
-	l := uint16(0)
-	for c := chnks.Front(); c != nil; c = c.Next() {
-		l += c.Value.(Chunk).Len()
+	return session.addr
+}
+
+// SetAddr changes far end address of the session
+func (session *Session) SetAddr(addr *net.UDPAddr) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	session.addr = addr
+}
+
+// PeerAddress returns far end address of the session
+func (session *Session) PeerAddress() *connection.PeerAddress {
+	addr := session.Addr()
+	if addr == nil {
+		return nil
 	}
 
-	if l > session.mtu {
-		fragmentsNum := uint16(l / session.mtu)
-		if l%session.mtu > 0 {
-			fragmentsNum++
-		}
+	peer := connection.PeerAddressFrom(addr)
+	peer.Origin = connection.RemoteOrigin
 
-		fragments := make([]chunks.FragmentChunk, fragmentsNum)
+	return peer
+}
 
-		for c := chnks.Front(); c != nil; c = c.Next() {
-			c.Value.(Chunk).WriteTo(fragmentBuff)
-		}
+// LastReceived returns time of the last received packet
+func (session *Session) LastReceived() time.Time {
+	session.mu.Lock()
+	defer session.mu.Unlock()
 
-		pcktID := atomic.AddUint32(&session.pcktCounter, 1)
+	return session.lastRecv
+}
 
-		for i := uint16(0); i < fragmentsNum; i++ {
-			fragment := &chunks.FragmentChunk{
-				MoreFragments: i == fragmentsNum-1,
-				PacketID:      vlu.Vlu(pcktID),
-				FragmentNum:   vlu.Vlu(i),
-			}
+// Receive handles packet came from addr
+func (session *Session) Receive(pckt *Packet, addr *net.UDPAddr) {
+	session.mu.Lock()
+	session.receive(pckt, addr)
 
-			if i == fragmentsNum-1 {
-				fragment.Fragment = fragmentSlice[i*session.mtu:]
-				break
+	acceptor, accepted := session.acceptor, session.takeAccepted()
+	session.mu.Unlock()
+
+	acceptFlows(acceptor, accepted)
+}
+
+func (session *Session) receive(pckt *Packet, addr *net.UDPAddr) {
+	if session.state == stateClosed {
+		return
+	}
+
+	session.addr = addr
+	session.lastRecv = time.Now()
+	session.pings = 0
+	session.rtt.received(pckt, session.lastRecv)
+
+	if pckt.TimeCriticalReserve { // Far end receives time critical data of someone
+		session.yieldTimeCritical(session.lastRecv)
+	}
+
+	userData := false
+	for c := pckt.Chunks.Front(); c != nil; c = c.Next() {
+		chnk := c.Value.(Chunk)
+		if session.Type != nil {
+			if !session.Type.IsValidChunkType(chnk.Type()) {
+				continue
 			}
 
-			fragment.Fragment = fragmentSlice[i*session.mtu : (i+1)*session.mtu]
-			fragments[i] = *fragment
+			session.Type.GotChunkType(chnk.Type())
+			session.Type = session.Type.NextType()
 		}
 
-		fragmentsList := list.New()
-
-		for _, fragment := range fragments {
-			fragmentsList.PushBack(fragment)
+		if chnk.Type() == chunks.UserDataChunkType || chnk.Type() == chunks.NextUserDataChunkType {
+			userData = true
 		}
 
-		return fragmentsList
+		session.handleChunk(chnk)
 	}
 
-	return nil
+	if userData {
+		session.receivedUserData(session.lastRecv)
+	}
 }
 
-var defragmentBuff = bytes.NewBuffer(make([]byte, packetMtu))
+func (session *Session) handleChunk(chnk Chunk) {
+	if session.state != stateOpen {
+		session.handleClosingChunk(chnk)
+		return
+	}
 
-func (session *Session) defragmentChunks(chnks *list.List) (*list.List, error) {
-	defragmentBuff.Reset()
+	switch c := chnk.(type) {
+	case *chunks.UserDataChunk:
+		session.handleUserData(c)
+	case *chunks.NextUserDataChunk:
+		session.handleUserData((*chunks.UserDataChunk)(c))
+	case *chunks.BufferProbeChunk:
+		if f := session.recvFlows[c.FlowID]; f != nil {
+			f.HandleProbe()
+		}
+	case *chunks.DataAcknowledgementBitmapChunk:
+		session.handleAck(c.FlowID, c)
+	case *chunks.DataAcknowledgementRangesChunk:
+		session.handleAck(c.FlowID, c)
+	case *chunks.FlowExceptionReportChunk:
+		session.handleException(c)
+	case *chunks.PingChunk:
+		session.handlePing(c)
+	case *chunks.PingReplyChunk:
+		session.handlePingReply(c)
+	case *chunks.SessionCloseRequestChunk:
+		session.handleCloseRequest(time.Now())
+	case *chunks.SessionCloseAcknowledgement:
+		session.handleCloseAck()
+	default:
+		// Unknown and unexpected chunks are ignored
+	}
+}
 
-	pckt := &Packet{}
-	pckt.writeTo(defragmentBuff)
+// Send queues chunk to be sent with one of the next packets
+func (session *Session) Send(chnk Chunk) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
 
-	for chunk := chnks.Front(); chunk != nil; chunk.Next() {
-		_, err := defragmentBuff.Write(chunk.Value.(chunks.FragmentChunk).Fragment)
+	session.outgoing.PushBack(chnk)
+}
 
-		if err != nil {
-			return nil, err
+// Flush packs queued chunks into packets ready to be written to the wire
+func (session *Session) Flush() ([]*bytes.Buffer, error) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	packets := make([]*bytes.Buffer, 0)
+
+	now := time.Now()
+	session.expireFragments(now)
+
+	if session.state == stateOpen {
+		session.keepalive(now)
+	}
+
+	if session.state == stateOpen { // Keepalive may close the session
+		session.queueAcks(now)
+		session.reapFlows(now)
+		session.drainFlows()
+	} else {
+		session.closing(now)
+	}
+
+	for session.outgoing.Len() > 0 {
+		pckt := Packet{
+			Mode:                session.Mode,
+			TimeCriticalReserve: withinTimeCritical(session.tcRecv, now),
+			Chunks:              list.New(),
 		}
+		session.rtt.stamp(&pckt, now)
+
+		size := packetOverhead
+		for c := session.outgoing.Front(); c != nil; c = session.outgoing.Front() {
+			chnk := nextUserData(pckt.Chunks.Back(), c.Value.(Chunk))
+
+			l := int(chnk.Len()) + 2 // length field
+			if pckt.Chunks.Len() > 0 && size+l > int(session.mtu) {
+				break
+			}
+
+			if session.isTimeCritical(c.Value.(Chunk)) {
+				pckt.TimeCritical = true
+				session.tcSent = now
+			}
+
+			pckt.Chunks.PushBack(chnk)
+			session.outgoing.Remove(c)
+			size += l
+		}
+
+		limit := session.mtu
+		if size > int(limit) && session.Mode == StartupMode { // Large certificates don't fit into a single packet
+			fragments, err := session.writeFragments(pckt)
+			if err != nil {
+				return packets, err
+			}
+
+			packets = append(packets, fragments...)
+			session.lastSent = now
+			continue
+		}
+
+		if size > int(limit) { // Reply to the larger MTU probe is sent whole
+			limit = uint16(size)
+		}
+
+		buff := bytes.NewBuffer(make([]byte, 0, limit))
+		if err := session.writePacket(pckt, buff, limit); err != nil {
+			return packets, err
+		}
+
+		packets = append(packets, buff)
+		session.lastSent = now
 	}
 
-	l, err := session.ReadPacket(defragmentBuff)
+	if session.state == stateOpen {
+		probe, err := session.discoverMTU(now)
+		if err != nil {
+			return packets, err
+		}
 
-	return l.Chunks, err
+		if probe != nil {
+			packets = append(packets, probe)
+		}
+	}
+
+	return packets, nil
 }
 
-// WritePacket Writes packet into the byte buffer
+// WritePacket Writes packet into the empty byte buffer
 func (session *Session) WritePacket(pckt Packet, buff *bytes.Buffer) error {
+	return session.writePacket(pckt, buff, session.mtu)
+}
 
+// writePacket writes packet into the buffer, packet larger than mtu is rejected
+func (session *Session) writePacket(pckt Packet, buff *bytes.Buffer, mtu uint16) error {
 	binary.Write(buff, binary.BigEndian, uint32(0))
 
 	if session.HasChecksums {
-		binary.Write(buff, binary.BigEndian, uint16(0))
+		buff.Write(make([]byte, session.profile.ChecksumLen()))
 	}
 
-	pckt.Chunks = session.fragmentChunks(pckt.Chunks)
-
 	pckt.writeTo(buff)
 	for c := pckt.Chunks.Front(); c != nil; c = c.Next() {
 		err := pckt.writeChunkTo(c.Value.(Chunk), buff)
@@ -226,23 +456,19 @@ func (session *Session) WritePacket(pckt Packet, buff *bytes.Buffer) error {
 		}
 	}
 
-	err := pckt.writePaddingTo(buff)
+	err := pckt.writePaddingTo(buff, 4) // ID isn't encrypted
 	if err != nil {
 		return err
 	}
 
-	peeker := bufio.NewReader(buff)
-	data, err := peeker.Peek(peeker.Buffered())
-	if err != nil {
-		return err
+	if buff.Len() > int(mtu) {
+		return errors.New("Packet is larger than MTU")
 	}
 
 	if session.HasChecksums {
-		if err = binary.Write(bytes.NewBuffer(buff.Bytes()),
-			binary.BigEndian,
-			ip.Checksum(data)); err != nil {
-			return err
-		}
+		data := buff.Bytes()
+		sumLen := session.profile.ChecksumLen()
+		copy(data[4:4+sumLen], session.profile.Checksum(data[4+sumLen:]))
 	}
 
 	err = session.encryptBuffer(buff)
@@ -259,7 +485,7 @@ func (session *Session) WritePacket(pckt Packet, buff *bytes.Buffer) error {
 func (session *Session) ReadPacket(buff *bytes.Buffer) (*Packet, error) {
 	pckt := &Packet{}
 
-	err := session.readID(buff)
+	_, err := session.readID(buff)
 	if err != nil {
 		return nil, err
 	}
@@ -271,29 +497,49 @@ func (session *Session) ReadPacket(buff *bytes.Buffer) (*Packet, error) {
 
 	pckt.Chunks = list.New()
 
-	checksum := uint16(0)
+	var checksum, calcedChecksum []byte
 	if session.HasChecksums {
-		err := binary.Read(buff, binary.BigEndian, &checksum)
-		if err != nil {
-			return pckt, err
+		checksum = buff.Next(session.profile.ChecksumLen())
+		if len(checksum) < session.profile.ChecksumLen() {
+			return pckt, errors.New("Packet is too short")
 		}
+
+		calcedChecksum = session.profile.Checksum(buff.Bytes())
 	}
 
 	if err = pckt.readFrom(buff); err != nil {
 		return pckt, err
 	}
 
-	if pckt.Mode < ResponderMode {
-		return pckt, errors.New("Only Responder and Startup packet modes are allowed")
+	if pckt.Mode == ForbiddenMode {
+		return pckt, errors.New("Forbidden packet mode")
+	}
+
+	if err = session.readChunks(pckt, buff); err != nil {
+		return pckt, err
+	}
+
+	if session.HasChecksums && !bytes.Equal(calcedChecksum, checksum) {
+		return pckt, errors.New("Wrong packet checksum")
 	}
 
+	return pckt, nil
+}
+
+// readChunks reads chunks up to the padding into the packet
+func (session *Session) readChunks(pckt *Packet, buff *bytes.Buffer) error {
 	datalen := uint16(0)
 
+	var err error
 	typ := byte(0)
 	for {
 
 		if typ, err = buff.ReadByte(); err != nil {
-			return pckt, err
+			if err == io.EOF { // Packet without padding
+				break
+			}
+
+			return err
 		}
 
 		if typ == 0xFF || typ == 0x00 {
@@ -306,7 +552,7 @@ func (session *Session) ReadPacket(buff *bytes.Buffer) (*Packet, error) {
 		case chunks.BufferProbeChunkType:
 			c := &chunks.BufferProbeChunk{}
 			if err = c.ReadFrom(buff); err != nil {
-				return pckt, err
+				return err
 			}
 			datalen += c.Len()
 			pckt.Chunks.PushBack(c)
@@ -315,7 +561,7 @@ func (session *Session) ReadPacket(buff *bytes.Buffer) (*Packet, error) {
 		case chunks.DataAcknowledgementBitmapChunkType:
 			c := &chunks.DataAcknowledgementBitmapChunk{}
 			if err = c.ReadFrom(buff); err != nil {
-				return pckt, err
+				return err
 			}
 			datalen += c.Len()
 			pckt.Chunks.PushBack(c)
@@ -324,7 +570,7 @@ func (session *Session) ReadPacket(buff *bytes.Buffer) (*Packet, error) {
 		case chunks.DataAcknowledgementRangesChunkType:
 			c := &chunks.DataAcknowledgementRangesChunk{}
 			if err = c.ReadFrom(buff); err != nil {
-				return pckt, err
+				return err
 			}
 			datalen += c.Len()
 			pckt.Chunks.PushBack(c)
@@ -333,7 +579,7 @@ func (session *Session) ReadPacket(buff *bytes.Buffer) (*Packet, error) {
 		case chunks.FlowExceptionReportChunkType:
 			c := &chunks.FlowExceptionReportChunk{}
 			if err = c.ReadFrom(buff); err != nil {
-				return pckt, err
+				return err
 			}
 			datalen += c.Len()
 			pckt.Chunks.PushBack(c)
@@ -342,64 +588,35 @@ func (session *Session) ReadPacket(buff *bytes.Buffer) (*Packet, error) {
 		case chunks.ForwardedHelloChunkType:
 			c := &chunks.ForwardedHelloChunk{}
 			if err = c.ReadFrom(buff); err != nil {
-				return pckt, err
+				return err
 			}
 			datalen += c.Len()
 			pckt.Chunks.PushBack(c)
 			break
 
-		// Store fragments
 		case chunks.FragmentChunkType:
 			c := &chunks.FragmentChunk{}
 			if err = c.ReadFrom(buff); err != nil {
-				return pckt, err
-			}
-
-			if session.fragments[c.PacketID] == nil {
-				session.fragments[c.PacketID] = list.New()
-			}
-
-			if c.FragmentNum < session.fragments[c.PacketID].Back().Value.(chunks.FragmentChunk).FragmentNum {
-				for fragment := session.fragments[c.PacketID].Front(); fragment != nil; fragment.Next() {
-					if fragment.Value.(chunks.FragmentChunk).FragmentNum > c.FragmentNum {
-						session.fragments[c.PacketID].InsertBefore(c, fragment)
-						break
-					}
-				}
-			} else {
-				session.fragments[c.PacketID].PushBack(c)
-			}
-
-			session.fragmentSizes[c.PacketID] += c.Len()
-
-			if session.fragments[c.PacketID].Len() > maxFragments {
-				delete(session.fragments, c.PacketID)
-				delete(session.fragmentSizes, c.PacketID)
-				return nil, errors.New("Too many fragments in the packet")
+				return err
 			}
+			datalen += c.Len()
 
-			if session.fragmentSizes[c.PacketID] > maxFragmentsSize {
-				delete(session.fragments, c.PacketID)
-				delete(session.fragmentSizes, c.PacketID)
-				return nil, errors.New("Too long fragmentated packet")
+			var data []byte
+			if data, err = session.reassemble(c, time.Now()); err != nil {
+				return err
 			}
 
-			if !c.MoreFragments {
-				pckt.Chunks, err = session.defragmentChunks(session.fragments[c.PacketID])
-				if err != nil {
-					return pckt, err
+			if data != nil { // The last missing fragment, chunks of the whole packet follow
+				if err = session.readChunks(pckt, bytes.NewBuffer(data)); err != nil {
+					return err
 				}
-
-				return pckt, nil
 			}
-
-			datalen += c.Len()
 			break
 
 		case chunks.HelloCookieChangeChunkType:
 			c := &chunks.HelloCookieChangeChunk{}
 			if err = c.ReadFrom(buff); err != nil {
-				return pckt, err
+				return err
 			}
 			datalen += c.Len()
 			pckt.Chunks.PushBack(c)
@@ -408,7 +625,7 @@ func (session *Session) ReadPacket(buff *bytes.Buffer) (*Packet, error) {
 		case chunks.InitiatorHelloChunkType:
 			c := &chunks.InitiatorHelloChunk{}
 			if err = c.ReadFrom(buff); err != nil {
-				return pckt, err
+				return err
 			}
 			datalen += c.Len()
 			pckt.Chunks.PushBack(c)
@@ -417,7 +634,7 @@ func (session *Session) ReadPacket(buff *bytes.Buffer) (*Packet, error) {
 		case chunks.InitiatorInitialKeyingChunkType:
 			c := &chunks.InitiatorInitialKeyingChunk{}
 			if err = c.ReadFrom(buff); err != nil {
-				return pckt, err
+				return err
 			}
 			datalen += c.Len()
 			pckt.Chunks.PushBack(c)
@@ -426,7 +643,11 @@ func (session *Session) ReadPacket(buff *bytes.Buffer) (*Packet, error) {
 		case chunks.NextUserDataChunkType:
 			c := &chunks.NextUserDataChunk{}
 			if err = c.ReadFrom(buff); err != nil {
-				return pckt, err
+				return err
+			}
+
+			if err = followUserData(c, pckt.Chunks.Back()); err != nil {
+				return err
 			}
 			datalen += c.Len()
 			pckt.Chunks.PushBack(c)
@@ -435,7 +656,7 @@ func (session *Session) ReadPacket(buff *bytes.Buffer) (*Packet, error) {
 		case chunks.PingReplyChunkType:
 			c := &chunks.PingReplyChunk{}
 			if err = c.ReadFrom(buff); err != nil {
-				return pckt, err
+				return err
 			}
 			datalen += c.Len()
 			pckt.Chunks.PushBack(c)
@@ -444,7 +665,7 @@ func (session *Session) ReadPacket(buff *bytes.Buffer) (*Packet, error) {
 		case chunks.PingChunkType:
 			c := &chunks.PingChunk{}
 			if err = c.ReadFrom(buff); err != nil {
-				return pckt, err
+				return err
 			}
 			datalen += c.Len()
 			pckt.Chunks.PushBack(c)
@@ -453,7 +674,7 @@ func (session *Session) ReadPacket(buff *bytes.Buffer) (*Packet, error) {
 		case chunks.ResponderHelloChunkType:
 			c := &chunks.ResponderHelloChunk{}
 			if err = c.ReadFrom(buff); err != nil {
-				return pckt, err
+				return err
 			}
 			datalen += c.Len()
 			pckt.Chunks.PushBack(c)
@@ -462,7 +683,7 @@ func (session *Session) ReadPacket(buff *bytes.Buffer) (*Packet, error) {
 		case chunks.ResponderInitialKeyingChunkType:
 			c := &chunks.ResponderInitialKeyingChunk{}
 			if err = c.ReadFrom(buff); err != nil {
-				return pckt, err
+				return err
 			}
 			datalen += c.Len()
 			pckt.Chunks.PushBack(c)
@@ -471,7 +692,7 @@ func (session *Session) ReadPacket(buff *bytes.Buffer) (*Packet, error) {
 		case chunks.ResponderRedirectChunkType:
 			c := &chunks.ResponderRedirectChunk{}
 			if err = c.ReadFrom(buff); err != nil {
-				return pckt, err
+				return err
 			}
 			datalen += c.Len()
 			pckt.Chunks.PushBack(c)
@@ -480,7 +701,7 @@ func (session *Session) ReadPacket(buff *bytes.Buffer) (*Packet, error) {
 		case chunks.SessionCloseAcknowledgementType:
 			c := &chunks.SessionCloseAcknowledgement{}
 			if err = c.ReadFrom(buff); err != nil {
-				return pckt, err
+				return err
 			}
 			datalen += c.Len()
 			pckt.Chunks.PushBack(c)
@@ -489,7 +710,7 @@ func (session *Session) ReadPacket(buff *bytes.Buffer) (*Packet, error) {
 		case chunks.SessionCloseRequestChunkType:
 			c := &chunks.SessionCloseRequestChunk{}
 			if err = c.ReadFrom(buff); err != nil {
-				return pckt, err
+				return err
 			}
 			datalen += c.Len()
 			pckt.Chunks.PushBack(c)
@@ -498,7 +719,7 @@ func (session *Session) ReadPacket(buff *bytes.Buffer) (*Packet, error) {
 		case chunks.UserDataChunkType:
 			c := &chunks.UserDataChunk{}
 			if err = c.ReadFrom(buff); err != nil {
-				return pckt, err
+				return err
 			}
 			datalen += c.Len()
 			pckt.Chunks.PushBack(c)
@@ -514,18 +735,5 @@ func (session *Session) ReadPacket(buff *bytes.Buffer) (*Packet, error) {
 		}
 	}
 
-	if session.HasChecksums {
-		peeker := bufio.NewReader(buff)
-		data, err := peeker.Peek(peeker.Buffered())
-		if err != nil {
-			return pckt, err
-		}
-
-		calcedChecksum := ip.Checksum(data)
-		if calcedChecksum != checksum {
-			return pckt, errors.New("Wrong packet checksum")
-		}
-	}
-
-	return pckt, nil
+	return nil
 }
@@ -17,33 +17,620 @@
 package session
 
 import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
 	"testing"
+	"time"
+
+	"github.com/rtmfpew/amfy/vlu"
+	"github.com/rtmfpew/rtmfpew/config"
+	"github.com/rtmfpew/rtmfpew/protocol/chunks"
+	"github.com/rtmfpew/rtmfpew/protocol/connection/flow"
+	"github.com/rtmfpew/rtmfpew/protocol/crypto"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
 
 func TestSessionChunksFragmentation(t *testing.T) {
-	Convey("Given a set of chunks", t, func() {
-		// chunks := []Chunk{}
+	Convey("Given a startup session and a chunk larger than mtu", t, func() {
+		sender := New(nil)
+		sender.RemoteID = 0x1A2B3C4D
+		receiver := New(nil)
+
+		message := bytes.Repeat([]byte{0xCD}, 3000)
+		sender.Send(&chunks.PingChunk{Message: message})
+
+		packets, err := sender.Flush()
+		So(err, ShouldBeNil)
+
+		read := func(buff *bytes.Buffer) (*Packet, error) { // Packets are decrypted in place
+			return receiver.ReadPacket(bytes.NewBuffer(append([]byte(nil), buff.Bytes()...)))
+		}
+
+		Convey("It should be split into packets fitting mtu", func() {
+			So(len(packets), ShouldEqual, 5)
+
+			for _, buff := range packets {
+				So(buff.Len(), ShouldBeLessThanOrEqualTo, int(sender.mtu))
+			}
+		})
+
+		Convey("Fragments should be numbered and only the last one should have no more fragments", func() {
+			chnks := list.New()
+			chnks.PushBack(&chunks.PingChunk{Message: message})
+
+			fragments, err := fragmentChunks(chnks, sender.mtu)
+			So(err, ShouldBeNil)
+			So(fragments.Len(), ShouldEqual, 5)
+
+			first := fragments.Front().Value.(*chunks.FragmentChunk)
+			num := vlu.Vlu(0)
+			for f := fragments.Front(); f != nil; f = f.Next() {
+				fragment := f.Value.(*chunks.FragmentChunk)
+				So(fragment.PacketID, ShouldEqual, first.PacketID)
+				So(fragment.FragmentNum, ShouldEqual, num)
+				So(fragment.MoreFragments, ShouldEqual, f.Next() != nil)
+				num++
+			}
+		})
+
+		Convey("Fragments should be reassembled in order", func() {
+			for i, buff := range packets {
+				pckt, err := read(buff)
+				So(err, ShouldBeNil)
+
+				if i < len(packets)-1 {
+					So(pckt.Chunks.Len(), ShouldEqual, 0)
+					So(receiver.Reassembling(), ShouldBeTrue)
+					continue
+				}
+
+				So(pckt.Chunks.Len(), ShouldEqual, 1)
+				So(pckt.Chunks.Front().Value.(*chunks.PingChunk).Message, ShouldResemble, message)
+			}
+
+			So(receiver.Reassembling(), ShouldBeFalse)
+		})
+
+		Convey("Reordered and duplicated fragments should be reassembled", func() {
+			order := []int{1, 0, 1, 3, 2, 4, 3}
+
+			delivered := 0
+			for _, i := range order {
+				pckt, err := read(packets[i])
+				So(err, ShouldBeNil)
+				delivered += pckt.Chunks.Len()
+			}
+
+			So(delivered, ShouldEqual, 1)
+		})
+
+		Convey("Fragment too far ahead of the missing one should drop the packet", func() {
+			_, err := read(packets[1])
+			So(err, ShouldBeNil)
+
+			_, err = read(packets[4])
+			So(err, ShouldNotBeNil)
+			So(receiver.Reassembling(), ShouldBeFalse)
+		})
+
+		Convey("Incomplete packet should be dropped after reassembly timeout", func() {
+			_, err := read(packets[0])
+			So(err, ShouldBeNil)
+
+			receiver.ExpireFragments(time.Now())
+			So(receiver.Reassembling(), ShouldBeTrue)
+
+			receiver.ExpireFragments(time.Now().Add(config.ReassemblyTimeout()))
+			So(receiver.Reassembling(), ShouldBeFalse)
+		})
+
+		Convey("Established session should send the chunk whole", func() {
+			established := New(nil)
+			established.Mode = ResponderMode
+			established.Send(&chunks.PingChunk{Message: message})
+
+			packets, err := established.Flush()
+			So(err, ShouldBeNil)
+			So(len(packets), ShouldEqual, 1)
+		})
+	})
+}
+
+func TestSessionPacketEncryption(t *testing.T) {
+	Convey("Given a session and a packet larger than cipher block", t, func() {
+		s := New(nil)
+		s.RemoteID = 0x1A2B3C4D
+
+		message := []byte("a ping message longer than a single cipher block")
+
+		pckt := Packet{
+			Mode:   StartupMode,
+			Chunks: list.New(),
+		}
+		pckt.Chunks.PushBack(&chunks.PingChunk{Message: message})
+
+		buff := bytes.NewBuffer(make([]byte, 0))
+		So(s.WritePacket(pckt, buff), ShouldBeNil)
+
+		Convey("Encrypted part should be padded to cipher block size", func() {
+			So((buff.Len()-4)%16, ShouldEqual, 0)
+		})
+
+		Convey("Payload shouldn't be sent in clear text", func() {
+			So(bytes.Contains(buff.Bytes(), message[16:]), ShouldBeFalse)
+		})
+
+		Convey("Session ID should be scrambled with the next two words", func() {
+			data := buff.Bytes()
+			So(binary.BigEndian.Uint32(data[0:4]), ShouldEqual, s.RemoteID^
+				binary.BigEndian.Uint32(data[4:8])^
+				binary.BigEndian.Uint32(data[8:12]))
+
+			ID, err := ReadID(data)
+			So(err, ShouldBeNil)
+			So(ID, ShouldEqual, s.RemoteID)
+		})
+
+		Convey("Packet should be read back", func() {
+			read, err := New(nil).ReadPacket(buff)
+			So(err, ShouldBeNil)
+			So(read.Chunks.Len(), ShouldEqual, 1)
+			So(read.Chunks.Front().Value.(*chunks.PingChunk).Message, ShouldResemble, message)
+		})
+
+		Convey("Corrupted packet length should be rejected", func() {
+			data := append(buff.Bytes(), 0x00)
+
+			_, err := New(nil).ReadPacket(bytes.NewBuffer(data))
+			So(err, ShouldNotBeNil)
+		})
 
-		Convey("They should be fragmented properly", func() {
+		Convey("Packet larger than mtu should be rejected", func() {
+			large := Packet{
+				Mode:   StartupMode,
+				Chunks: list.New(),
+			}
+			large.Chunks.PushBack(&chunks.PingChunk{Message: make([]byte, s.mtu)})
 
+			So(s.WritePacket(large, bytes.NewBuffer(make([]byte, 0))), ShouldNotBeNil)
 		})
+	})
+}
+
+func TestSessionPacketChecksum(t *testing.T) {
+	Convey("Given a startup session and a packet", t, func() {
+		s := NewStartup()
+		So(s.HasChecksums, ShouldBeTrue)
+
+		pckt := Packet{
+			Mode:   StartupMode,
+			Chunks: list.New(),
+		}
+		pckt.Chunks.PushBack(&chunks.PingChunk{Message: []byte{0x01, 0x02, 0x03}})
+
+		buff := bytes.NewBuffer(make([]byte, 0))
+		So(s.WritePacket(pckt, buff), ShouldBeNil)
+
+		profile := &crypto.FlashProfile{}
+		So(profile.InitDefault(), ShouldBeNil)
+
+		plain := bytes.NewBuffer(append([]byte{}, buff.Bytes()[4:]...))
+		So(profile.DecryptAt(plain, 0), ShouldBeNil)
+
+		Convey("Checksum should precede the packet the way Flash Player writes it", func() {
+			So(plain.Bytes(), ShouldResemble, []byte{
+				0xf7, 0xfa, // Checksum
+				0x03,                   // Startup mode flags
+				0x01, 0x00, 0x03, 0x01, // Ping
+				0x02, 0x03,
+				0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // Padding
+			})
+		})
+
+		Convey("Packet should be read back", func() {
+			read, err := NewStartup().ReadPacket(buff)
+			So(err, ShouldBeNil)
+			So(read.Chunks.Len(), ShouldEqual, 1)
+		})
+
+		Convey("Packet with wrong checksum should be rejected", func() {
+			plain.Bytes()[1] ^= 0x01
+			So(profile.EncryptAt(plain, 0), ShouldBeNil)
+
+			data := append(append([]byte{}, buff.Bytes()[:4]...), plain.Bytes()...)
+			_, err := NewStartup().ReadPacket(bytes.NewBuffer(data))
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestSessionFlows(t *testing.T) {
+	Convey("Given two sessions", t, func() {
+		sender := New(&NormalSessionType{})
+		sender.RemoteID = 0x1122
+		receiver := New(&NormalSessionType{})
+
+		Convey("Flow messages should be delivered through packets", func() {
+			f := sender.OpenFlow(nil)
+			So(f.ID(), ShouldEqual, 1)
+			So(sender.OpenFlow(nil).ID(), ShouldEqual, 2)
+
+			msg := bytes.Repeat([]byte{0xAB}, 2000)
+			f.Write(msg)
+			f.Write([]byte("short"))
+
+			packets, err := sender.Flush()
+			So(err, ShouldBeNil)
+			So(len(packets), ShouldBeGreaterThan, 1)
+
+			for i := len(packets) - 1; i >= 0; i-- {
+				So(packets[i].Len(), ShouldBeLessThanOrEqualTo, int(sender.mtu))
 
-		Convey("Fragements should be sorted", func() {
+				pckt, err := receiver.ReadPacket(packets[i])
+				So(err, ShouldBeNil)
+				receiver.Receive(pckt, nil)
+			}
 
+			recv := receiver.ReceiveFlow(f.ID())
+			So(recv, ShouldNotBeNil)
+			So(len(receiver.Flows()), ShouldEqual, 1)
+
+			read, err := recv.ReadMessage()
+			So(err, ShouldBeNil)
+			So(read, ShouldResemble, msg)
+
+			read, err = recv.ReadMessage()
+			So(err, ShouldBeNil)
+			So(read, ShouldResemble, []byte("short"))
 		})
 
-		Convey("And defragmented back", func() {
+		Convey("Finished receive flow should be forgotten after lingering", func() {
+			f := sender.OpenFlow(nil)
+			f.Write([]byte("last"))
+			f.Close()
+
+			packets, err := sender.Flush()
+			So(err, ShouldBeNil)
+
+			for _, buff := range packets {
+				pckt, err := receiver.ReadPacket(buff)
+				So(err, ShouldBeNil)
+				receiver.Receive(pckt, nil)
+			}
+
+			now := time.Now()
+			receiver.reapFlows(now)
+			So(receiver.ReceiveFlow(f.ID()), ShouldNotBeNil)
 
+			receiver.reapFlows(now.Add(config.FlowLingerTimeout()))
+			So(receiver.ReceiveFlow(f.ID()), ShouldBeNil)
+			So(len(receiver.lingering), ShouldEqual, 0)
 		})
+	})
+}
+
+func TestSessionAcknowledgements(t *testing.T) {
+	Convey("Given a session receiving user data", t, func() {
+		s := New(&NormalSessionType{})
+		sender := flow.NewSendFlow(vlu.Vlu(1), 16)
+
+		receive := func(n int) {
+			sender.Write(bytes.Repeat([]byte{0x01}, n))
+
+			pckt := &Packet{Chunks: list.New()}
+			for chnk := sender.NextChunk(); chnk != nil; chnk = sender.NextChunk() {
+				pckt.Chunks.PushBack(chnk)
+			}
 
-		Convey("Packet should be written properly", func() {
+			s.Receive(pckt, nil)
+		}
 
+		Convey("Single packet should be acknowledged after delay", func() {
+			receive(4)
+
+			now := time.Now()
+			s.queueAcks(now)
+			So(s.outgoing.Len(), ShouldEqual, 0)
+
+			s.queueAcks(now.Add(config.DelayedAckTimeout()))
+			So(s.outgoing.Len(), ShouldEqual, 1)
+
+			ack := s.outgoing.Front().Value.(*chunks.DataAcknowledgementBitmapChunk)
+			So(ack.CumulativeAck, ShouldEqual, 1)
 		})
 
-		Convey("And read back", func() {
+		Convey("Every second packet should be acknowledged right away", func() {
+			receive(4)
+			receive(4)
+
+			s.queueAcks(time.Now())
+			So(s.outgoing.Len(), ShouldEqual, 1)
+			So(s.outgoing.Front().Value.(*chunks.DataAcknowledgementBitmapChunk).CumulativeAck, ShouldEqual, 2)
+
+			s.queueAcks(time.Now())
+			So(s.outgoing.Len(), ShouldEqual, 1)
+		})
+
+		Convey("Out of order fragments should be acknowledged right away", func() {
+			sender.Write([]byte{0x01})
+			sender.NextChunk()
+
+			receive(4)
+
+			s.queueAcks(time.Now())
+			So(s.outgoing.Len(), ShouldEqual, 1)
+			So(s.outgoing.Front().Value.(*chunks.DataAcknowledgementBitmapChunk).Acknowledgement, ShouldResemble, []byte{0x01})
+		})
+	})
+}
+
+func TestSessionRetransmission(t *testing.T) {
+	Convey("Given two sessions with a flow", t, func() {
+		sender := New(&NormalSessionType{})
+		receiver := New(&NormalSessionType{})
+
+		f := sender.OpenFlow(nil)
+
+		exchange := func(from *Session, to *Session, drop func(i int) bool) {
+			packets, err := from.Flush()
+			So(err, ShouldBeNil)
+
+			for i, packet := range packets {
+				if drop != nil && drop(i) {
+					continue
+				}
+
+				pckt, err := to.ReadPacket(packet)
+				So(err, ShouldBeNil)
+				to.Receive(pckt, nil)
+			}
+		}
+
+		Convey("Consecutive fragments should be packed as next user data", func() {
+			f.Write([]byte{0x01})
+			f.Write([]byte{0x02})
+			f.Write([]byte{0x03})
+
+			packets, err := sender.Flush()
+			So(err, ShouldBeNil)
+			So(len(packets), ShouldEqual, 1)
+
+			pckt, err := receiver.ReadPacket(packets[0])
+			So(err, ShouldBeNil)
+			So(pckt.Chunks.Len(), ShouldEqual, 3)
+
+			next, ok := pckt.Chunks.Back().Value.(*chunks.NextUserDataChunk)
+			So(ok, ShouldBeTrue)
+			So(next.SequenceNumber, ShouldEqual, 3)
+			So(next.FlowID, ShouldEqual, f.ID())
+
+			receiver.Receive(pckt, nil)
+			So(receiver.ReceiveFlow(f.ID()).Buffered(), ShouldEqual, 3)
+		})
+
+		Convey("User data in flight should be limited by congestion window", func() {
+			f.Write(bytes.Repeat([]byte{0x01}, 16*sender.MSS()))
+
+			packets, err := sender.Flush()
+			So(err, ShouldBeNil)
+			So(len(packets), ShouldEqual, 4)
+			So(f.InFlight(), ShouldEqual, 4*sender.MSS())
+
+			packets, err = sender.Flush()
+			So(err, ShouldBeNil)
+			So(len(packets), ShouldEqual, 0)
+		})
+
+		Convey("Closed receive window should be probed", func() {
+			f.Write([]byte{0x01})
+			exchange(sender, receiver, nil)
+
+			recv := receiver.ReceiveFlow(f.ID())
+			recv.SetBufferSize(0)
+			receiver.ackDeadline = time.Now()
+			exchange(receiver, sender, nil)
+			So(f.Window(), ShouldEqual, 0)
+
+			f.Write([]byte{0x02})
+			packets, err := sender.Flush()
+			So(err, ShouldBeNil)
+			So(len(packets), ShouldEqual, 1)
+
+			pckt, err := receiver.ReadPacket(packets[0])
+			So(err, ShouldBeNil)
+			So(pckt.Chunks.Len(), ShouldEqual, 1)
+			So(pckt.Chunks.Front().Value, ShouldHaveSameTypeAs, &chunks.BufferProbeChunk{})
+
+			receiver.Receive(pckt, nil)
+			_, immediate := recv.NeedsAck()
+			So(immediate, ShouldBeTrue)
+		})
+
+		Convey("Flow rejected by receiver should be closed with exception", func() {
+			f.Write([]byte{0x01})
+			exchange(sender, receiver, nil)
+
+			So(receiver.ReceiveFlow(f.ID()).Reject(vlu.Vlu(7)), ShouldBeNil)
+			exchange(receiver, sender, nil)
+
+			_, err := f.Write([]byte{0x02})
+			So(err, ShouldResemble, &flow.FlowException{Code: 7})
+
+			exchange(sender, receiver, nil)
+			So(receiver.ReceiveFlow(f.ID()).Finished(), ShouldBeTrue)
+
+			receiver.ackDeadline = time.Now()
+			exchange(receiver, sender, nil)
+			So(f.Wait(), ShouldResemble, &flow.FlowException{Code: 7})
+
+			sender.Flush()
+			So(len(sender.Flows()), ShouldEqual, 0)
+		})
+
+		Convey("Lost packet should be retransmitted on timeout", func() {
+			f.Write(bytes.Repeat([]byte{0x01}, 1000))
+			exchange(sender, receiver, func(i int) bool { return i == 0 })
+
+			sender.rto = 0
+			exchange(sender, receiver, nil)
+
+			recv := receiver.ReceiveFlow(f.ID())
+			So(recv.Buffered(), ShouldEqual, 1)
+
+			receiver.ackDeadline = time.Now()
+			exchange(receiver, sender, nil)
+			So(f.Outstanding(), ShouldEqual, 0)
+			So(sender.rto, ShouldEqual, config.MinRetransmitTimeout())
+		})
+	})
+}
+
+func TestSessionTimeCritical(t *testing.T) {
+	Convey("Given two sessions with a time critical flow", t, func() {
+		sender := New(&NormalSessionType{})
+		receiver := New(&NormalSessionType{})
+
+		f := sender.OpenFlow(nil)
+		f.SetTimeCritical(true)
+		f.Write([]byte{0x01})
+
+		packets, err := sender.Flush()
+		So(err, ShouldBeNil)
+
+		pckt, err := receiver.ReadPacket(packets[0])
+		So(err, ShouldBeNil)
+		So(pckt.TimeCritical, ShouldBeTrue)
+		So(sender.SendsTimeCritical(time.Now()), ShouldBeTrue)
+
+		receiver.Receive(pckt, nil)
+
+		Convey("Receiver shouldn't report time critical data of the same session", func() {
+			window := receiver.congestion.Window()
+
+			receiver.Send(&chunks.PingChunk{Message: []byte{0x01}})
+			packets, err := receiver.Flush()
+			So(err, ShouldBeNil)
+
+			pckt, err := sender.ReadPacket(packets[0])
+			So(err, ShouldBeNil)
+			So(pckt.TimeCritical, ShouldBeFalse)
+			So(pckt.TimeCriticalReserve, ShouldBeFalse)
+			So(receiver.congestion.Window(), ShouldEqual, window)
+		})
+
+		Convey("Time critical sender shouldn't yield to the reserve notification", func() {
+			receiver.TimeCriticalObserved(true, time.Now())
+			receiver.Send(&chunks.PingChunk{Message: []byte{0x01}})
+			packets, err := receiver.Flush()
+			So(err, ShouldBeNil)
+
+			pckt, err := sender.ReadPacket(packets[0])
+			So(err, ShouldBeNil)
+			So(pckt.TimeCriticalReserve, ShouldBeTrue)
+
+			window := sender.congestion.Window()
+			sender.Receive(pckt, nil)
+			So(sender.congestion.Window(), ShouldEqual, window)
+		})
+
+		Convey("The other sessions of the host should yield", func() {
+			other := New(&NormalSessionType{})
+			window := other.congestion.Window()
+
+			other.TimeCriticalObserved(true, time.Now())
+			So(other.congestion.Window(), ShouldBeLessThan, window)
+
+			other.Send(&chunks.PingChunk{Message: []byte{0x01}})
+			packets, err := other.Flush()
+			So(err, ShouldBeNil)
+
+			pckt, err := receiver.ReadPacket(packets[0])
+			So(err, ShouldBeNil)
+			So(pckt.TimeCriticalReserve, ShouldBeTrue)
+		})
+	})
+}
+
+func TestSessionReturnFlows(t *testing.T) {
+	Convey("Given two sessions with flow acceptors", t, func() {
+		a := New(&NormalSessionType{})
+		b := New(&NormalSessionType{})
+
+		exchange := func(from *Session, to *Session) {
+			packets, err := from.Flush()
+			So(err, ShouldBeNil)
+
+			for _, packet := range packets {
+				So(packet.Len(), ShouldBeLessThanOrEqualTo, int(from.mtu))
+
+				pckt, err := to.ReadPacket(packet)
+				So(err, ShouldBeNil)
+				to.Receive(pckt, nil)
+			}
+		}
+
+		type accepted struct {
+			flow       *flow.ReceiveFlow
+			associated *flow.SendFlow
+		}
+
+		acceptedByA := make([]accepted, 0)
+		a.SetFlowAcceptor(func(f *flow.ReceiveFlow, associated *flow.SendFlow) {
+			acceptedByA = append(acceptedByA, accepted{f, associated})
+		})
+
+		var reply *flow.SendFlow
+		b.SetFlowAcceptor(func(f *flow.ReceiveFlow, associated *flow.SendFlow) {
+			So(associated, ShouldBeNil)
+			reply = b.OpenReturnFlow(nil, f.ID())
+		})
+
+		Convey("Metadata should be seen by acceptor before data is read", func() {
+			f := a.OpenFlow([]byte("TC\x04\x00\x00"))
+			f.Write([]byte{0x01})
+
+			var metadata []byte
+			b.SetFlowAcceptor(func(f *flow.ReceiveFlow, associated *flow.SendFlow) {
+				metadata = f.Metadata()
+			})
+
+			exchange(a, b)
+			So(metadata, ShouldResemble, []byte("TC\x04\x00\x00"))
+		})
+
+		Convey("Flows opened before acceptor is set should be kept for it", func() {
+			b.SetFlowAcceptor(nil)
+
+			f := a.OpenFlow([]byte{0x01})
+			f.Write([]byte{0x01})
+			exchange(a, b)
+
+			var accepted *flow.ReceiveFlow
+			b.SetFlowAcceptor(func(f *flow.ReceiveFlow, associated *flow.SendFlow) {
+				accepted = f
+			})
+
+			So(accepted, ShouldNotBeNil)
+			So(accepted.Metadata(), ShouldResemble, []byte{0x01})
+		})
+
+		Convey("Reply should be associated with the request flow", func() {
+			request := a.OpenFlow(nil)
+			request.Write([]byte{0x01})
+			exchange(a, b)
+			So(reply, ShouldNotBeNil)
+
+			reply.Write(bytes.Repeat([]byte{0x02}, 2*b.MSS()))
+			exchange(b, a)
+
+			So(len(acceptedByA), ShouldEqual, 1)
+			So(acceptedByA[0].associated, ShouldEqual, request)
 
+			ID, ok := acceptedByA[0].flow.ReturnFlowID()
+			So(ok, ShouldBeTrue)
+			So(ID, ShouldEqual, request.ID())
 		})
 	})
 }
@@ -0,0 +1,331 @@
+//
+// Copyright 2014 RTMFPew
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/rtmfpew/rtmfpew/protocol/chunks"
+	"github.com/rtmfpew/rtmfpew/protocol/session"
+)
+
+// Connect initiates session with the endpoint at addr and waits for the handshake
+func (ctx *Context) Connect(goCtx context.Context, addr *net.UDPAddr, epd []byte) (*session.Session, error) {
+	if ctx.isClosing() {
+		return nil, ErrClosed
+	}
+
+	in, err := ctx.newInitiator(addr, epd)
+	if err != nil {
+		return nil, err
+	}
+	defer ctx.removeInitiator(in.SessionID)
+
+	select {
+	case <-in.Done():
+	case <-goCtx.Done():
+		in.Cancel(goCtx.Err())
+	case <-ctx.closing:
+		in.Cancel(ErrClosed)
+	}
+
+	s, err := in.Result()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx.AddSession(s)
+
+	return s, nil
+}
+
+func (ctx *Context) newInitiator(addr *net.UDPAddr, epd []byte) (*session.Initiator, error) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	ID, err := ctx.newSessionID()
+	if err != nil {
+		return nil, err
+	}
+
+	in, err := session.NewInitiator(addr, epd, ID)
+	if err != nil {
+		return nil, err
+	}
+
+	in.Timeout = ctx.HandshakeTimeout
+	ctx.initiators[ID] = in
+
+	return in, nil
+}
+
+func (ctx *Context) removeInitiator(ID uint32) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	delete(ctx.initiators, ID)
+}
+
+// newSessionID picks random unused session ID, caller must hold the lock
+func (ctx *Context) newSessionID() (uint32, error) {
+	b := make([]byte, 4)
+
+	for {
+		if _, err := rand.Read(b); err != nil {
+			return 0, err
+		}
+
+		ID := binary.BigEndian.Uint32(b)
+		if ID == 0 || ctx.sessions[ID] != nil || ctx.initiators[ID] != nil {
+			continue
+		}
+
+		return ID, nil
+	}
+}
+
+// dispatchStartup handles startup mode packets of the handshakes in progress,
+// session ID 0 is used by the far ends yet to get a session
+func (ctx *Context) dispatchStartup(ID uint32, data []byte, addr *net.UDPAddr) {
+	ctx.mu.RLock()
+	in := ctx.initiators[ID]
+	ctx.mu.RUnlock()
+
+	if ID != 0 && in == nil {
+		atomic.AddUint64(&ctx.unknownIDs, 1)
+		return
+	}
+
+	reader := ctx.startupReader(addr)
+	pckt, err := reader.ReadPacket(bytes.NewBuffer(data))
+	ctx.releaseStartupReader(reader, addr)
+
+	if err != nil || pckt.Mode != session.StartupMode {
+		return
+	}
+
+	for c := pckt.Chunks.Front(); c != nil; c = c.Next() {
+		switch chnk := c.Value.(type) {
+		case *chunks.InitiatorHelloChunk:
+			if ctx.responder == nil || ID != 0 {
+				continue
+			}
+
+			if rhello := ctx.responder.HandleInitiatorHello(chnk, addr); rhello != nil {
+				ctx.sendStartup(rhello, 0, addr)
+			}
+
+		case *chunks.InitiatorInitialKeyingChunk:
+			if ctx.responder == nil || ID != 0 {
+				continue
+			}
+
+			ctx.handleInitiatorKeying(chnk, addr)
+
+		case *chunks.ResponderHelloChunk:
+			ctx.handleResponderHello(chnk, addr)
+
+		case *chunks.HelloCookieChangeChunk:
+			if in == nil {
+				continue
+			}
+
+			keying, err := in.HandleCookieChange(chnk)
+			if err != nil {
+				continue
+			}
+
+			ctx.sendStartup(keying, 0, addr)
+
+		case *chunks.ResponderInitialKeyingChunk:
+			if in == nil {
+				continue
+			}
+
+			if _, err := in.HandleResponderKeying(chnk, addr); err != nil {
+				continue
+			}
+		}
+	}
+}
+
+// startupReader returns session reading startup packets from addr, it keeps
+// fragments of the packets from the same address until they are reassembled
+func (ctx *Context) startupReader(addr *net.UDPAddr) *session.Session {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if reader := ctx.startup[addr.String()]; reader != nil {
+		return reader
+	}
+
+	reader := session.NewStartup()
+	if len(ctx.startup) < maxStartupReassemblies {
+		ctx.startup[addr.String()] = reader
+	}
+
+	return reader
+}
+
+// releaseStartupReader forgets the reader once it has no fragments to reassemble
+func (ctx *Context) releaseStartupReader(reader *session.Session, addr *net.UDPAddr) {
+	if reader.Reassembling() {
+		return
+	}
+
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if ctx.startup[addr.String()] == reader {
+		delete(ctx.startup, addr.String())
+	}
+}
+
+// expireStartupFragments drops startup packets not reassembled in time
+func (ctx *Context) expireStartupFragments(now time.Time) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	for key, reader := range ctx.startup {
+		reader.ExpireFragments(now)
+
+		if !reader.Reassembling() {
+			delete(ctx.startup, key)
+		}
+	}
+}
+
+func (ctx *Context) handleResponderHello(chnk *chunks.ResponderHelloChunk, addr *net.UDPAddr) {
+	ctx.mu.RLock()
+	initiators := make([]*session.Initiator, 0, len(ctx.initiators))
+	for _, in := range ctx.initiators {
+		initiators = append(initiators, in)
+	}
+	ctx.mu.RUnlock()
+
+	for _, in := range initiators {
+		if !bytes.Equal(in.Tag, chnk.TagEcho) {
+			continue
+		}
+
+		keying, err := in.HandleResponderHello(chnk, addr)
+		if err != nil {
+			return
+		}
+
+		ctx.sendStartup(keying, 0, addr)
+		return
+	}
+}
+
+func (ctx *Context) handleInitiatorKeying(chnk *chunks.InitiatorInitialKeyingChunk, addr *net.UDPAddr) {
+	s, fresh, err := ctx.responder.HandleInitiatorKeying(chnk, addr)
+	if err == session.ErrCookieAddressChanged {
+		if change, err := ctx.responder.ChangeCookie(chnk, addr); err == nil {
+			ctx.sendStartup(change, chnk.InitiatorSessionID, addr)
+		}
+
+		return
+	}
+
+	if err != nil {
+		return
+	}
+
+	if fresh && !ctx.establish(s) {
+		ctx.responder.Forget(chnk.CookieEcho) // Initiator retries once backlog is accepted
+		return
+	}
+
+	if keying := ctx.responder.Keying(chnk.CookieEcho); keying != nil {
+		ctx.sendStartup(keying, s.RemoteID, addr)
+	}
+}
+
+// establish assigns ID to the session initiated by a far end and queues it for Accept.
+// Session is dropped when accept backlog is full.
+func (ctx *Context) establish(s *session.Session) bool {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if len(ctx.accept) == cap(ctx.accept) {
+		return false
+	}
+
+	ID, err := ctx.newSessionID()
+	if err != nil {
+		return false
+	}
+
+	s.ID = ID
+	ctx.configure(s)
+	ctx.sessions[ID] = s
+	ctx.accept <- s
+
+	return true
+}
+
+// pollHandshakes retransmits handshake chunks
+func (ctx *Context) pollHandshakes(now time.Time) {
+	ctx.mu.RLock()
+	initiators := make([]*session.Initiator, 0, len(ctx.initiators))
+	for _, in := range ctx.initiators {
+		initiators = append(initiators, in)
+	}
+	ctx.mu.RUnlock()
+
+	if ctx.responder != nil {
+		ctx.responder.Poll(now)
+	}
+
+	ctx.expireStartupFragments(now)
+
+	for _, in := range initiators {
+		chnk, err := in.Poll(now)
+		if err != nil || chnk == nil {
+			continue
+		}
+
+		ctx.sendStartup(chnk, 0, in.Addr())
+	}
+}
+
+// sendStartup writes startup mode packet with a single chunk to addr
+func (ctx *Context) sendStartup(chnk session.Chunk, remoteID uint32, addr *net.UDPAddr) error {
+	s := session.NewStartup()
+	s.RemoteID = remoteID
+	s.Send(chnk)
+
+	packets, err := s.Flush()
+	if err != nil {
+		return err
+	}
+
+	for _, pckt := range packets {
+		if _, err = ctx.conn.WriteToUDP(pckt.Bytes(), addr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
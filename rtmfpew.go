@@ -17,51 +17,76 @@
 package rtmfp
 
 import (
+	"context"
 	"errors"
 	"log"
 	"net/url"
-	"os"
 	"strconv"
 
-	"github.com/rtmfpew/rtmfpew/protocol"
+	"github.com/rtmfpew/rtmfpew/protocol/crypto"
 )
 
 const DefaultPort = 1935
 
-func Connect(addr string) error {
+// Dial connects to the RTMFP server at rtmfp://host:port/app address
+func Dial(ctx context.Context, addr string) (*Conn, error) {
 
 	url, err := url.Parse(addr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if url.Scheme != "rtmfp" {
-		return errors.New("Protocol " + url.Scheme + " is not supported")
+		return nil, errors.New("Protocol " + url.Scheme + " is not supported")
 	}
 
 	if len(url.Fragment) > 0 {
-		log.Println("URL Fragment %s will be ignored", url.Fragment)
+		log.Printf("URL Fragment %s will be ignored", url.Fragment)
 	}
 
 	if len(url.Query().Encode()) > 0 {
-		log.Println("URL Query %s will be ignored", url.Query().Encode())
+		log.Printf("URL Query %s will be ignored", url.Query().Encode())
 	}
 
 	if url.Host == ":" {
 		url.Host = ""
 	}
 
-	if len(url.Host) > 0 {
-		return rtmfpew.clientMode(url.Host)
+	if len(url.Host) == 0 {
+		return nil, errors.New("Host is required to dial")
 	}
 
-	return rtmfpew.serverlessMode()
-}
+	endpoint, host, err := clientMode(url.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	epd, err := crypto.AncillaryDataEpd([]byte(url.String())).Bytes()
+	if err != nil {
+		endpoint.Close()
+		return nil, err
+	}
+
+	s, err := endpoint.Connect(ctx, host, epd)
+	if err != nil {
+		endpoint.Close()
+		return nil, err
+	}
 
-func ListenSpecific(host string) error {
-	return protocol.Run(host, protocol.ServerMode)
+	return newConn(endpoint, s, url, true), nil
 }
 
-func Listen() error {
-	return protocol.Run("0.0.0.0:"+strconv.Itoa(DefaultPort), protocol.ServerMode)
+// Listen announces RTMFP server on the local host:port address.
+// Default port is used when it's omitted, and all interfaces when host is empty.
+func Listen(addr string) (*Listener, error) {
+	if len(addr) == 0 {
+		addr = "0.0.0.0:" + strconv.Itoa(DefaultPort)
+	}
+
+	endpoint, err := serverMode(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Listener{endpoint: endpoint}, nil
 }
@@ -17,5 +17,103 @@
 package rtmfp
 
 import (
+	"context"
+	"testing"
+	"time"
+
 	"github.com/rtmfpew/rtmfpew/protocol"
+	"github.com/rtmfpew/rtmfpew/protocol/session"
+
+	. "github.com/smartystreets/goconvey/convey"
 )
+
+func TestModes(t *testing.T) {
+	Convey("Given a server mode endpoint", t, func() {
+		ctx, err := serverMode("127.0.0.1:0")
+		So(err, ShouldBeNil)
+		So(ctx.Mode, ShouldEqual, protocol.ServerMode)
+
+		Convey("It should be bound to an ephemeral port of the requested host", func() {
+			So(ctx.Addr().IP.String(), ShouldEqual, "127.0.0.1")
+			So(ctx.Addr().Port, ShouldNotEqual, 0)
+		})
+
+		Reset(func() {
+			ctx.Close()
+		})
+	})
+
+	Convey("Given hosts with and without ports", t, func() {
+
+		Convey("Default port should be added only when it's missing", func() {
+			So(withDefaultPort("127.0.0.1"), ShouldEqual, "127.0.0.1:1935")
+			So(withDefaultPort("example.com"), ShouldEqual, "example.com:1935")
+			So(withDefaultPort("example.com:"), ShouldEqual, "example.com:1935")
+			So(withDefaultPort("::1"), ShouldEqual, "[::1]:1935")
+			So(withDefaultPort("[::1]"), ShouldEqual, "[::1]:1935")
+			So(withDefaultPort(""), ShouldEqual, ":1935")
+		})
+
+		Convey("Explicit ports should be kept", func() {
+			So(withDefaultPort("127.0.0.1:0"), ShouldEqual, "127.0.0.1:0")
+			So(withDefaultPort("example.com:1936"), ShouldEqual, "example.com:1936")
+			So(withDefaultPort("[::1]:1936"), ShouldEqual, "[::1]:1936")
+		})
+	})
+}
+
+func TestConn(t *testing.T) {
+	Convey("Given a connection which far end address is unknown yet", t, func() {
+		conn := newConn(nil, session.New(&session.NormalSessionType{}), nil, false)
+
+		Convey("Remote address should be nil interface", func() {
+			So(conn.RemoteAddr() == nil, ShouldBeTrue)
+		})
+	})
+}
+
+func TestDial(t *testing.T) {
+	Convey("Given malformed addresses", t, func() {
+
+		Convey("Dial should reject other protocols", func() {
+			conn, err := Dial(context.Background(), "rtmp://127.0.0.1:1935/app")
+			So(err, ShouldNotBeNil)
+			So(conn, ShouldBeNil)
+		})
+
+		Convey("Dial should require host", func() {
+			conn, err := Dial(context.Background(), "rtmfp:///app")
+			So(err, ShouldNotBeNil)
+			So(conn, ShouldBeNil)
+		})
+	})
+}
+
+func TestListener(t *testing.T) {
+	Convey("Given a listener", t, func() {
+		listener, err := Listen("127.0.0.1:0")
+		So(err, ShouldBeNil)
+		So(listener.Addr(), ShouldNotBeNil)
+
+		Convey("Accept should respect context deadline", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+
+			conn, err := listener.Accept(ctx)
+			So(err, ShouldEqual, context.DeadlineExceeded)
+			So(conn, ShouldBeNil)
+		})
+
+		Convey("Accept should fail after Close", func() {
+			So(listener.Close(), ShouldBeNil)
+
+			conn, err := listener.Accept(context.Background())
+			So(err, ShouldEqual, protocol.ErrClosed)
+			So(conn, ShouldBeNil)
+		})
+
+		Reset(func() {
+			listener.Close()
+		})
+	})
+}